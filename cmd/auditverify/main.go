@@ -0,0 +1,39 @@
+// Checks an audit file written by the game server
+//
+//	go run ./cmd/auditverify -file audit.jsonl
+//
+// The HMAC key is read from AUDIT_KEY, same as the server
+// Exits 1 at the first record that was modified, removed or reordered
+package main
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	path := flag.String("file", "audit.jsonl", "audit file to verify")
+	flag.Parse()
+
+	f, err := os.Open(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	last, err := audit.Verify(f, []byte(os.Getenv("AUDIT_KEY")))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(1)
+	}
+
+	if last == nil {
+		fmt.Println("OK: empty")
+		return
+	}
+	// compare with the head recorded elsewhere to catch records cut off the end
+	fmt.Printf("OK: %d records, head %s\n", last.Seq, last.Hash)
+}
@@ -1,20 +1,226 @@
 package main
 
 import (
+	"cgoncalveslck/dicegame/cmd/internal/admin"
+	"cgoncalveslck/dicegame/cmd/internal/audit"
 	"cgoncalveslck/dicegame/cmd/internal/client"
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"cgoncalveslck/dicegame/cmd/internal/config"
 	"cgoncalveslck/dicegame/cmd/internal/handlers"
-	"log"
+	"cgoncalveslck/dicegame/cmd/internal/identity"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"cgoncalveslck/dicegame/cmd/internal/ratelimit"
+	"cgoncalveslck/dicegame/cmd/internal/round"
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"cgoncalveslck/dicegame/cmd/internal/tlsreload"
+	"cgoncalveslck/dicegame/cmd/internal/tracing"
+	"context"
+	"errors"
+	"flag"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+func rulesLoaded(r *rules.Rules) {
+	slog.Info("Game rules loaded", slog.String("version", r.Version))
+	audit.Write(audit.Entry{Event: "rules_loaded", Data: map[string]interface{}{"version": r.Version}})
+}
+
+func rateRules(r config.RateRules) ratelimit.Rules {
+	rules := make(ratelimit.Rules, len(r))
+	for kind, rule := range r {
+		rules[kind] = ratelimit.Rule{Rate: rule.Rate, Burst: rule.Burst}
+	}
+	return rules
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, slog.Any("error", err))
+	os.Exit(1)
+}
+
 func main() {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+
+	logger, err := logging.New(os.Stderr, logging.Config{
+		Level:       cfg.Log.Level,
+		Format:      cfg.Log.Format,
+		SampleEvery: cfg.Log.Sample,
+		Sampled:     logging.DefaultSampled,
+	})
+	if err != nil {
+		fatal("Invalid logging configuration", err)
+	}
+	slog.SetDefault(logger)
+	slog.LogAttrs(context.Background(), slog.LevelInfo, "Configuration", cfg.LogAttrs()...)
+
+	if cfg.Audit.Key == "" {
+		slog.Warn("AUDIT_KEY not set, the audit log can be rewritten without being noticed")
+	}
+	a, err := audit.Open(cfg.Audit.File, []byte(cfg.Audit.Key))
+	if err != nil {
+		fatal("Opening the audit log failed", err)
+	}
+	defer a.Close()
+	audit.Default = a
+
+	// the OTLP endpoint comes from OTEL_EXPORTER_OTLP_ENDPOINT
+	shutdown, err := tracing.Setup(context.Background(), cfg.Traces)
+	if err != nil {
+		fatal("Tracing setup failed", err)
+	}
+	defer shutdown(context.Background())
 
 	http.HandleFunc("/", handlers.Handler)
+	http.HandleFunc("/register", handlers.Register)
+	http.HandleFunc("/login", handlers.Login)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("GET /healthz", handlers.Healthz)
+	http.HandleFunc("GET /readyz", handlers.Readyz)
+	http.HandleFunc("GET /version", handlers.VersionHandler)
+	metrics.RegisterStore(
+		func() int { clients, _ := client.St.Counts(); return clients },
+		func() int { _, sessions := client.St.Counts(); return sessions },
+	)
+	http.HandleFunc("GET /auth/{provider}/login", handlers.IdentityLogin)
+	http.HandleFunc("GET /auth/{provider}/callback", handlers.IdentityCallback)
+
+	if cfg.OIDC.Issuer != "" {
+		p, err := identity.NewOIDC(context.Background(), identity.OIDCConfig{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			Scopes:       cfg.OIDC.Scopes,
+		}, clock.Real{})
+		if err != nil {
+			fatal("OIDC setup failed", err)
+		}
+		handlers.Providers[p.Name()] = p
+	}
+	client.AllowGuests = cfg.AllowGuests
+	client.StartingBalance = cfg.StartingBalance
+	client.HistorySize = cfg.HistorySize
+	client.IdleTimeout = cfg.IdleTimeout
+	client.IdleWarning = cfg.IdleWarning
+	client.MaxDevices = cfg.MaxDevices
+	client.RealityCheckInterval = cfg.RealityCheckInterval
+	client.TableRounds = round.Config{
+		Betting: cfg.Tables.Betting,
+		Locked:  cfg.Tables.Locked,
+		Result:  cfg.Tables.Result,
+		Tick:    cfg.Tables.Tick,
+	}
+	client.JackpotPercent = cfg.Jackpot.Percent
+	client.JackpotSeed = cfg.Jackpot.Seed
+	// the pool was made with the default seed
+	client.St.Jackpot = &client.Jackpot{Pool: cfg.Jackpot.Seed}
+	handlers.PingInterval = cfg.PingInterval
+	handlers.PongTimeout = cfg.PongTimeout
+	handlers.Admit.AllowedOrigins = cfg.AllowedOrigins
+	handlers.Admit.MaxConnections = cfg.MaxConnections
+	handlers.Admit.MaxConnectionsPerIP = cfg.MaxConnectionsPerIP
+	handlers.Admit.MaxMessageSize = int64(cfg.MaxMessageSize)
+	handlers.Limiter = ratelimit.New(ratelimit.Config{
+		PerConn:         rateRules(cfg.RateLimit.PerConn),
+		PerClient:       rateRules(cfg.RateLimit.PerClient),
+		PerIP:           rateRules(cfg.RateLimit.PerIP),
+		MaxViolations:   cfg.RateLimit.MaxViolations,
+		ViolationWindow: cfg.RateLimit.ViolationWindow,
+	}, clock.Real{})
+
+	if cfg.Rules.File != "" {
+		r, err := rules.Load(cfg.Rules.File)
+		if err != nil {
+			fatal("Loading the game rules failed", err)
+		}
+		rules.Set(r)
+		rulesLoaded(r)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go rules.Watch(context.Background(), cfg.Rules.File, cfg.Rules.ReloadInterval, hup, rulesLoaded)
+	}
+
+	if cfg.AdminToken != "" {
+		h := admin.Handler(cfg.AdminToken)
+		if cfg.TLS.AdminClientCA != "" {
+			h = admin.RequireClientCert(h)
+		}
+		http.Handle("/admin/", h)
+	}
+
+	go client.JackpotUpdates()
+	_, err = client.ScheduleTournament(client.DefaultTournament)
+	if err != nil {
+		fatal("Scheduling the tournament failed", err)
+	}
+
+	srv := &http.Server{
+		Addr:     cfg.Listen,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	if cfg.TLS.CertFile != "" {
+		certs, err := tlsreload.New(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			fatal("Loading the TLS certificate failed", err)
+		}
+		srv.TLSConfig, err = certs.Config(cfg.TLS.AdminClientCA)
+		if err != nil {
+			fatal("Loading the admin client CA failed", err)
+		}
+		go certs.Watch(context.Background(), cfg.TLS.ReloadInterval)
+	}
+
+	// hijacked connections aren't closed by Shutdown
+	srv.RegisterOnShutdown(func() {
+		client.St.SettleAll(client.SettledShutdown)
+		client.St.CloseAll(websocket.CloseGoingAway, "server shutting down")
+	})
+
+	go func() {
+		slog.Info("Starting server", slog.String("listen", cfg.Listen), slog.Bool("tls", cfg.TLS.CertFile != ""))
+		var err error
+		if cfg.TLS.CertFile != "" {
+			// the certificate comes from TLSConfig.GetCertificate
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
 
-	go client.SessionExpire()
+	// /readyz fails for a while first so load balancers stop sending new
+	// connections before the open ones are closed
+	slog.Info("Shutting down", slog.Duration("drain", cfg.DrainDelay))
+	handlers.Drain()
+	time.Sleep(cfg.DrainDelay)
 
-	slog.Info("Starting server on :8181")
-	log.Fatal(http.ListenAndServe(":8181", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Shutdown error", slog.Any("error", err))
+	}
+	slog.Info("Server stopped")
 }
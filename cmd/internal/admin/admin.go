@@ -0,0 +1,188 @@
+package admin
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/client"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const maxReasonLength = 200
+
+// Version of the routes below, bumped when a change breaks callers
+const APIVersion = 1
+
+// Operator API under /admin/, every request needs "Authorization: Bearer <token>"
+// An empty token refuses everything
+func Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/clients", listClients)
+	mux.HandleFunc("GET /admin/clients/{id}", getClient)
+	mux.HandleFunc("GET /admin/clients/{id}/history", getHistory)
+	mux.HandleFunc("POST /admin/clients/{id}/wallet", adjustWallet)
+	mux.HandleFunc("POST /admin/clients/{id}/endsession", endSession)
+	mux.HandleFunc("POST /admin/clients/{id}/disconnect", disconnect)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Refuses requests that didn't come with a client certificate the server
+// verified, on top of the token. Needs a TLS server asking for them
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeError(w, http.StatusForbidden, "client certificate required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Who did it, for the logs, the certificate's common name when there is one
+func actor(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	name := "admin"
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			name = cn
+		}
+	}
+	return name + "@" + ip
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("Encoding response failed", slog.Any("error", err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// Client from the {id} path value, writes the 404 itself
+func findClient(w http.ResponseWriter, r *http.Request) *client.Client {
+	c := client.FindClient(r.PathValue("id"))
+	if c == nil {
+		writeError(w, http.StatusNotFound, "client not found")
+	}
+	return c
+}
+
+func listClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, client.St.List())
+}
+
+func getClient(w http.ResponseWriter, r *http.Request) {
+	c := findClient(w, r)
+	if c == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Info())
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	c := findClient(w, r)
+	if c == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, c.History())
+}
+
+type walletRequest struct {
+	Amount int    `json:"amount"` // negative debits
+	Reason string `json:"reason"`
+}
+
+func adjustWallet(w http.ResponseWriter, r *http.Request) {
+	c := findClient(w, r)
+	if c == nil {
+		return
+	}
+
+	req := &walletRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to parse JSON")
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch {
+	case req.Amount == 0:
+		writeError(w, http.StatusBadRequest, "amount can't be 0")
+		return
+	case req.Reason == "":
+		writeError(w, http.StatusBadRequest, "reason is required")
+		return
+	case len(req.Reason) > maxReasonLength:
+		writeError(w, http.StatusBadRequest, "reason is too long")
+		return
+	}
+
+	wallet, ok := c.AdjustWallet(r.Context(), req.Amount, req.Reason, actor(r))
+	if !ok {
+		writeError(w, http.StatusConflict, "debit is more than the wallet holds")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"wallet": wallet})
+}
+
+func endSession(w http.ResponseWriter, r *http.Request) {
+	c := findClient(w, r)
+	if c == nil {
+		return
+	}
+
+	result, ok := c.ForceEndSession(r.Context(), actor(r))
+	if !ok {
+		writeError(w, http.StatusConflict, "not playing")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func disconnect(w http.ResponseWriter, r *http.Request) {
+	c := findClient(w, r)
+	if c == nil {
+		return
+	}
+
+	client.St.DisconnectClient(r.Context(), c)
+	slog.Info("Client disconnected by operator", slog.String("clientId", c.Id), slog.String("actor", actor(r)))
+	audit.WriteContext(r.Context(), audit.Entry{Event: "disconnect", ClientId: c.Id, Actor: actor(r)})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+package admin_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/admin"
+	"cgoncalveslck/dicegame/cmd/internal/client"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const token = "s3cret"
+
+func do(t *testing.T, h http.Handler, method, path, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func newClient() *client.Client {
+	c := &client.Client{}
+	c.Init()
+	client.St.AddClient(c)
+	return c
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	h := admin.Handler(token)
+
+	for _, auth := range []string{"", "wrong"} {
+		rec := do(t, h, http.MethodGet, "/admin/clients", auth, "")
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with %q but got %d", auth, rec.Code)
+		}
+	}
+
+	// no token configured refuses everyone
+	rec := do(t, admin.Handler(""), http.MethodGet, "/admin/clients", "", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 but got %d", rec.Code)
+	}
+}
+
+func TestAdminListClients(t *testing.T) {
+	h := admin.Handler(token)
+	c := newClient()
+
+	rec := do(t, h, http.MethodGet, "/admin/clients", token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", rec.Code)
+	}
+
+	var infos []client.ClientInfo
+	err := json.Unmarshal(rec.Body.Bytes(), &infos)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	found := false
+	for _, info := range infos {
+		if info.Id == c.Id {
+			found = true
+			if info.Wallet != 100 || info.Online || info.Session != nil {
+				t.Errorf("Unexpected info %+v", info)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected %s in the list", c.Id)
+	}
+
+	rec = do(t, h, http.MethodGet, "/admin/clients/"+c.Id+"/history", token, "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("Expected empty history but got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAdminAdjustWallet(t *testing.T) {
+	h := admin.Handler(token)
+	c := newClient()
+	path := "/admin/clients/" + c.Id + "/wallet"
+
+	rec := do(t, h, http.MethodPost, path, token, `{"amount": 50}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a reason but got %d", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodPost, path, token, `{"amount": 50, "reason": "goodwill, ticket 42"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d: %s", rec.Code, rec.Body)
+	}
+	if c.Balance() != 150 {
+		t.Errorf("Expected wallet 150 but got %d", c.Balance())
+	}
+
+	rec = do(t, h, http.MethodPost, path, token, `{"amount": -500, "reason": "chargeback"}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 but got %d", rec.Code)
+	}
+	if c.Balance() != 150 {
+		t.Errorf("Expected wallet 150 but got %d", c.Balance())
+	}
+}
+
+func TestAdminEndSessionAndDisconnect(t *testing.T) {
+	h := admin.Handler(token)
+	c := newClient()
+
+	rec := do(t, h, http.MethodPost, "/admin/clients/"+c.Id+"/endsession", token, "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 when not playing but got %d", rec.Code)
+	}
+
+	cErr, err := c.StartSession(context.Background(), &client.DefaultMessage{Kind: "STARTPLAY", ClientId: c.Id})
+	if cErr != nil || err != nil {
+		t.Fatalf("Error: %+v %+v", cErr, err)
+	}
+	if c.Info().Session == nil {
+		t.Fatalf("Expected a session")
+	}
+
+	rec = do(t, h, http.MethodPost, "/admin/clients/"+c.Id+"/endsession", token, "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 but got %d", rec.Code)
+	}
+	if c.Info().Session != nil {
+		t.Errorf("Expected the session to be over")
+	}
+
+	rec = do(t, h, http.MethodPost, "/admin/clients/"+c.Id+"/disconnect", token, "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 but got %d", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodGet, "/admin/clients/"+c.Id, token, "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after disconnect but got %d", rec.Code)
+	}
+}
+
+func TestAdminClientCert(t *testing.T) {
+	h := admin.RequireClientCert(admin.Handler(token))
+
+	rec := do(t, h, http.MethodGet, "/admin/clients", token, "")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a client certificate but got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ops"}}}},
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with a verified certificate but got %d", rec.Code)
+	}
+
+	// the certificate doesn't replace the token
+	req.Header.Del("Authorization")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the token but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,229 @@
+package audit
+
+import (
+	"bufio"
+	"cgoncalveslck/dicegame/cmd/internal/tracing"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// One line of the audit file
+// Hash covers every other field, Prev is the Hash of the record before so
+// changing or removing a record breaks every hash after it
+type Record struct {
+	Seq      uint64                 `json:"seq"`
+	Time     time.Time              `json:"time"`
+	Event    string                 `json:"event"`
+	ClientId string                 `json:"clientId,omitempty"`
+	Actor    string                 `json:"actor,omitempty"` // who did it when it isn't the client, "admin@1.2.3.4"
+	Data     map[string]interface{} `json:"data,omitempty"`
+	Prev     string                 `json:"prev"`
+	Hash     string                 `json:"hash"`
+}
+
+// What callers fill in, the rest is added by the logger
+type Entry struct {
+	Event    string
+	ClientId string
+	Actor    string
+	Data     map[string]interface{}
+}
+
+// Appends records to a file, safe for concurrent use
+type Logger struct {
+	path string
+	f    *os.File
+	key  []byte
+	seq  uint64
+	prev string
+	mx   sync.Mutex
+}
+
+// Where Write goes, nil means auditing is off
+var Default *Logger
+
+// Opens path for appending and picks the chain up where it ended
+// With a key hashes are HMAC-SHA256 so they can't be recomputed without it,
+// otherwise plain SHA-256 which only catches accidental damage
+func Open(path string, key []byte) (*Logger, error) {
+	l := &Logger{path: path, key: key}
+
+	existing, err := os.Open(path)
+	if err == nil {
+		last, err := Verify(existing, key)
+		existing.Close()
+		if err != nil {
+			return nil, fmt.Errorf("audit: %s doesn't verify: %w", path, err)
+		}
+		if last != nil {
+			l.seq = last.Seq
+			l.prev = last.Hash
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	l.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) Close() error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.f.Close()
+}
+
+// Fails if records can't be written, the file was closed or removed from
+// under the logger
+func (l *Logger) Check() error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	_, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(l.path)
+	return err
+}
+
+func hash(r *Record, key []byte) (string, error) {
+	unhashed := *r
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	var sum []byte
+	if len(key) > 0 {
+		m := hmac.New(sha256.New, key)
+		m.Write(data)
+		sum = m.Sum(nil)
+	} else {
+		s := sha256.Sum256(data)
+		sum = s[:]
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// Appends e as the next record and syncs it to disk
+func (l *Logger) Write(e Entry) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	r := &Record{
+		Seq:      l.seq + 1,
+		Time:     time.Now().UTC(),
+		Event:    e.Event,
+		ClientId: e.ClientId,
+		Actor:    e.Actor,
+		Data:     e.Data,
+		Prev:     l.prev,
+	}
+
+	h, err := hash(r, l.key)
+	if err != nil {
+		return err
+	}
+	r.Hash = h
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = l.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	l.seq = r.Seq
+	l.prev = r.Hash
+	return nil
+}
+
+// Writes to Default, failures are logged since the game can't do much about them
+func Write(e Entry) {
+	if Default == nil {
+		return
+	}
+
+	err := Default.Write(e)
+	if err != nil {
+		slog.Error("Audit write failed", slog.String("event", e.Event), slog.Any("error", err))
+	}
+}
+
+// Write under its own span when ctx is traced
+func WriteContext(ctx context.Context, e Entry) {
+	_, span := tracing.StartChild(ctx, "audit.Write", trace.WithAttributes(attribute.String("audit.event", e.Event)))
+	defer span.End()
+
+	Write(e)
+}
+
+// Checks every record of r in order, returns the last one
+// Catches changed records, removed or reordered ones and anything appended
+// by hand. Removing records from the end can't be seen from the file alone,
+// compare the returned record with a copy kept elsewhere for that
+func Verify(r io.Reader, key []byte) (*Record, error) {
+	var last *Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		rec := &Record{}
+		err := json.Unmarshal(scanner.Bytes(), rec)
+		if err != nil {
+			return last, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		want, err := hash(rec, key)
+		if err != nil {
+			return last, fmt.Errorf("line %d: %w", line, err)
+		}
+		if !hmac.Equal([]byte(want), []byte(rec.Hash)) {
+			return last, fmt.Errorf("line %d: record %d was modified", line, rec.Seq)
+		}
+
+		prevSeq, prevHash := uint64(0), ""
+		if last != nil {
+			prevSeq, prevHash = last.Seq, last.Hash
+		}
+		if rec.Seq != prevSeq+1 || rec.Prev != prevHash {
+			return last, fmt.Errorf("line %d: record %d doesn't follow record %d, records were removed or reordered", line, rec.Seq, prevSeq)
+		}
+
+		last = rec
+	}
+
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+	return last, nil
+}
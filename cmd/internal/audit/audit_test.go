@@ -0,0 +1,124 @@
+package audit_test
+
+import (
+	"bytes"
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var key = []byte("test-key")
+
+// Writes n records to a fresh file and returns its path
+func writeLog(t *testing.T, n int) string {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	l, err := audit.Open(path, key)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < n; i++ {
+		err = l.Write(audit.Entry{
+			Event:    "play",
+			ClientId: "c1",
+			Data:     map[string]interface{}{"bet": 10 + i, "result": "WIN"},
+		})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+	}
+	return path
+}
+
+func verify(t *testing.T, data []byte, key []byte) (*audit.Record, error) {
+	t.Helper()
+	return audit.Verify(bytes.NewReader(data), key)
+}
+
+func lines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAuditVerify(t *testing.T) {
+	path := writeLog(t, 5)
+	data, _ := os.ReadFile(path)
+
+	last, err := verify(t, data, key)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if last.Seq != 5 {
+		t.Errorf("Expected 5 records but got %d", last.Seq)
+	}
+
+	_, err = verify(t, data, []byte("wrong-key"))
+	if err == nil {
+		t.Errorf("Expected the wrong key to fail")
+	}
+}
+
+func TestAuditReopenContinuesChain(t *testing.T) {
+	path := writeLog(t, 3)
+
+	l, err := audit.Open(path, key)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	err = l.Write(audit.Entry{Event: "session_end", ClientId: "c1"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	l.Close()
+
+	data, _ := os.ReadFile(path)
+	last, err := verify(t, data, key)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if last.Seq != 4 || last.Event != "session_end" {
+		t.Errorf("Expected record 4 to be session_end but got %d %s", last.Seq, last.Event)
+	}
+}
+
+func TestAuditDetectsTampering(t *testing.T) {
+	path := writeLog(t, 5)
+	ls := lines(t, path)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"modified", ls[0] + ls[1] + strings.Replace(ls[2], `"bet":12`, `"bet":1200`, 1) + ls[3] + ls[4]},
+		{"deleted", ls[0] + ls[1] + ls[3] + ls[4]},
+		{"deleted first", ls[1] + ls[2] + ls[3] + ls[4]},
+		{"reordered", ls[0] + ls[2] + ls[1] + ls[3] + ls[4]},
+		{"garbage", ls[0] + "not json\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verify(t, []byte(tt.data), key)
+			if err == nil {
+				t.Errorf("Expected verification to fail")
+			}
+		})
+	}
+
+	// a tampered file isn't appended to
+	err := os.WriteFile(path, []byte(tests[0].data), 0o600)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	_, err = audit.Open(path, key)
+	if err == nil {
+		t.Errorf("Expected Open to refuse a tampered file")
+	}
+}
@@ -0,0 +1,274 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// bcrypt work factor, tests lower it to keep hashing fast
+	BcryptCost = bcrypt.DefaultCost
+
+	// failed logins in a row before an account is locked, 0 disables it
+	MaxLoginFailures = 5
+	LoginLockout     = 15 * time.Minute
+)
+
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72 // bcrypt ignores anything past 72 bytes
+)
+
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// Compared against when the username doesn't exist so a missing account
+// takes as long to reject as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dicegame-dummy-password"), bcrypt.DefaultCost)
+
+// Registered login for a client, the client (and its wallet) outlives the
+// connection and is put back in the store on the next login
+type Account struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	hash        []byte
+	client      *Client
+	failures    int
+	lockedUntil time.Time
+	mx          sync.Mutex // failures and lockout, also serializes password checks
+}
+
+type AccountResultMessage struct {
+	Kind     string   `json:"kind"`
+	ClientId string   `json:"clientId"`
+	Username string   `json:"username"`
+	Profile  *Profile `json:"profile"`
+	Token    string   `json:"token,omitempty"` // HTTP only, AUTH the socket with it and clientId
+}
+
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
+
+func validCredentials(username, password string) *ErrorResultMessage {
+	if !usernameRe.MatchString(username) {
+		return &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid username (3-32 letters, digits, _, . or -)",
+			Code:    INVALID_USERNAME,
+		}
+	}
+
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid password (8-72 characters)",
+			Code:    WEAK_PASSWORD,
+		}
+	}
+
+	return nil
+}
+
+// Creates an account for guest, or for a brand new client when guest is nil
+// A guest keeps its id, wallet and profile
+func RegisterAccount(ctx context.Context, username, password string, guest *Client) (*Client, *ErrorResultMessage) {
+	cErr := validCredentials(username, password)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	// slow on purpose, keep it out of the store lock
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+	if err != nil {
+		logging.FromContext(ctx).Error("bcrypt failed", slog.Any("error", err))
+		return nil, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid password",
+			Code:    WEAK_PASSWORD,
+		}
+	}
+
+	c := guest
+	if c == nil {
+		c = &Client{}
+	}
+
+	St.Mx.Lock()
+	if c.account != nil {
+		St.Mx.Unlock()
+		return nil, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Already registered",
+			Code:    ACCOUNT_EXISTS,
+		}
+	}
+
+	key := accountKey(username)
+	if _, taken := St.Accounts[key]; taken {
+		St.Mx.Unlock()
+		return nil, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Username already taken",
+			Code:    USERNAME_TAKEN,
+		}
+	}
+
+	// only once nothing can fail, a refused registration leaves no client
+	// behind with an expiry running
+	if guest == nil {
+		c.Init()
+	}
+
+	a := &Account{
+		Username:  username,
+		CreatedAt: time.Now(),
+		hash:      hash,
+		client:    c,
+	}
+	St.Accounts[key] = a
+	c.account = a
+	St.Clients[c.Id] = c
+	St.Mx.Unlock()
+
+	logging.FromContext(ctx).Info("Account registered", slog.String("clientId", c.Id), slog.String("username", username), slog.Bool("guest", guest != nil))
+	audit.WriteContext(ctx, audit.Entry{
+		Event:    "register",
+		ClientId: c.Id,
+		Data: map[string]interface{}{
+			"username": username,
+			"guest":    guest != nil,
+		},
+	})
+	return c, nil
+}
+
+// Checks username and password, returns the account's client back in the
+// store if it had expired
+// Unknown usernames and wrong passwords get the same error
+func Authenticate(ctx context.Context, username, password string) (*Client, *ErrorResultMessage) {
+	invalid := &ErrorResultMessage{
+		Kind:    "ERROR",
+		Message: "Invalid username or password",
+		Code:    INVALID_CREDENTIALS,
+	}
+
+	St.Mx.Lock()
+	a, ok := St.Accounts[accountKey(username)]
+	St.Mx.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		audit.WriteContext(ctx, audit.Entry{Event: "login_failed", Data: map[string]interface{}{"username": username, "reason": "unknown username"}})
+		return nil, invalid
+	}
+
+	a.mx.Lock()
+	now := time.Now()
+	if now.Before(a.lockedUntil) {
+		retry := a.lockedUntil.Sub(now)
+		a.mx.Unlock()
+		audit.WriteContext(ctx, audit.Entry{Event: "login_failed", ClientId: a.client.Id, Data: map[string]interface{}{"username": a.Username, "reason": "locked"}})
+		return nil, &ErrorResultMessage{
+			Kind:       "ERROR",
+			Message:    "Too many failed logins, account locked",
+			Code:       ACCOUNT_LOCKED,
+			RetryAfter: int(retry.Milliseconds()),
+		}
+	}
+
+	err := bcrypt.CompareHashAndPassword(a.hash, []byte(password))
+	if err != nil {
+		a.failures++
+		locked := MaxLoginFailures > 0 && a.failures >= MaxLoginFailures
+		if locked {
+			a.failures = 0
+			a.lockedUntil = now.Add(LoginLockout)
+			logging.FromContext(ctx).Info("Account locked", slog.String("username", a.Username), slog.Duration("for", LoginLockout))
+		}
+		a.mx.Unlock()
+		audit.WriteContext(ctx, audit.Entry{Event: "login_failed", ClientId: a.client.Id, Data: map[string]interface{}{"username": a.Username, "reason": "wrong password", "locked": locked}})
+		return nil, invalid
+	}
+	a.failures = 0
+	a.mx.Unlock()
+
+	c := a.client
+	St.Mx.Lock()
+	St.Clients[c.Id] = c
+	St.Mx.Unlock()
+	c.Touch()
+
+	logging.FromContext(ctx).Info("Account logged in", slog.String("clientId", c.Id), slog.String("username", a.Username))
+	audit.WriteContext(ctx, audit.Entry{Event: "login", ClientId: c.Id, Data: map[string]interface{}{"username": a.Username}})
+	return c, nil
+}
+
+// REGISTER on a connection, a guest that already has a clientId is turned
+// into the account, otherwise a new client is created for this device
+func (c *Client) Register(ctx context.Context, d *Device, msg *DefaultMessage) (*Client, error) {
+	var guest *Client
+	if c.Id != "" {
+		guest = c
+	}
+
+	registered, cErr := RegisterAccount(ctx, msg.Username, msg.Password, guest)
+	if cErr != nil {
+		return c, d.SendMessageContext(ctx, cErr)
+	}
+
+	if registered != c && !c.moveDevice(ctx, d, registered, false) {
+		return c, nil
+	}
+
+	profile := registered.ProfileSnapshot()
+	err := registered.SendMessageContext(ctx, &AccountResultMessage{
+		Kind:     "REGISTER",
+		ClientId: registered.Id,
+		Username: msg.Username,
+		Profile:  &profile,
+	})
+
+	return registered, err
+}
+
+// LOGIN on a connection, the device moves to the account's client
+func (c *Client) Login(ctx context.Context, d *Device, msg *DefaultMessage) (*Client, error) {
+	account, cErr := Authenticate(ctx, msg.Username, msg.Password)
+	if cErr != nil {
+		return c, d.SendMessageContext(ctx, cErr)
+	}
+
+	if account == c {
+		return c, d.SendMessageContext(ctx, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "already logged",
+			Code:    ALREADY_LOGGED,
+		})
+	}
+
+	if !c.moveDevice(ctx, d, account, msg.Kick) {
+		return c, nil
+	}
+
+	profile := account.ProfileSnapshot()
+	err := d.SendMessageContext(ctx, &AccountResultMessage{
+		Kind:     "LOGIN",
+		ClientId: account.Id,
+		Username: account.account.Username,
+		Profile:  &profile,
+	})
+	if err != nil {
+		return account, err
+	}
+	account.reportSettled(ctx, d)
+
+	return account, nil
+}
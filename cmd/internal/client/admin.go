@@ -0,0 +1,151 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// What operators see of a client
+type ClientInfo struct {
+	Id       string       `json:"clientId"`
+	Username string       `json:"username,omitempty"`
+	Profile  Profile      `json:"profile"`
+	Wallet   int          `json:"wallet"`
+	LastSeen time.Time    `json:"lastSeen"`
+	Online   bool         `json:"online"`
+	Devices  []*Device    `json:"devices"`
+	Session  *SessionInfo `json:"session"` // nil when not playing
+}
+
+type SessionInfo struct {
+	StartedAt   time.Time `json:"startedAt"`
+	Profit      int       `json:"profit"`
+	Plays       int       `json:"plays"`
+	AwaitingAck bool      `json:"awaitingAck"`
+}
+
+// Pushed when an operator changes the wallet
+type WalletAdjustedMessage struct {
+	Kind   string `json:"kind"`
+	Amount int    `json:"amount"`
+	Wallet int    `json:"wallet"`
+	Reason string `json:"reason"`
+}
+
+func FindClient(id string) *Client {
+	St.Mx.Lock()
+	defer St.Mx.Unlock()
+	return St.Clients[id]
+}
+
+// Every client in the store, oldest first
+func (s *Store) List() []ClientInfo {
+	s.Mx.Lock()
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, c := range s.Clients {
+		clients = append(clients, c)
+	}
+	s.Mx.Unlock()
+
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Profile.CreatedAt.Before(infos[j].Profile.CreatedAt)
+	})
+	return infos
+}
+
+func (c *Client) Info() ClientInfo {
+	St.Mx.Lock()
+	username := ""
+	if c.account != nil {
+		username = c.account.Username
+	}
+	St.Mx.Unlock()
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	info := ClientInfo{
+		Id:       c.Id,
+		Username: username,
+		Profile:  c.Profile,
+		Wallet:   c.Wallet,
+		LastSeen: time.Unix(c.Last_seen, 0),
+		Online:   len(c.Devices) > 0,
+		Devices:  append([]*Device{}, c.Devices...),
+	}
+
+	if s := c.Session; s != nil && s.Playing {
+		info.Session = &SessionInfo{
+			StartedAt:   s.StartedAt,
+			Profit:      s.Profit,
+			Plays:       s.Plays,
+			AwaitingAck: s.AwaitingAck,
+		}
+	}
+	return info
+}
+
+// Plays of the current session, oldest first
+func (c *Client) History() []PlayHistoryItem {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.Session == nil || c.Session.PlayHistory == nil {
+		return []PlayHistoryItem{}
+	}
+	return append([]PlayHistoryItem{}, c.Session.PlayHistory.Items...)
+}
+
+// Credits (amount > 0) or debits (amount < 0) the wallet on an operator's
+// behalf, false if a debit is more than the wallet holds
+func (c *Client) AdjustWallet(ctx context.Context, amount int, reason, actor string) (int, bool) {
+	c.mx.Lock()
+	if c.Wallet+amount < 0 {
+		c.mx.Unlock()
+		return 0, false
+	}
+	c.Wallet += amount
+	wallet := c.Wallet
+	c.mx.Unlock()
+
+	logging.FromContext(ctx).Info("Wallet adjusted", slog.String("clientId", c.Id), slog.Int("amount", amount), slog.Int("wallet", wallet), slog.String("reason", reason), slog.String("actor", actor))
+	audit.WriteContext(ctx, audit.Entry{
+		Event:    "wallet",
+		ClientId: c.Id,
+		Actor:    actor,
+		Data: map[string]interface{}{
+			"amount":  amount,
+			"balance": wallet,
+			"reason":  reason,
+		},
+	})
+
+	broadcastContext(ctx, []*Client{c}, &WalletAdjustedMessage{
+		Kind:   "WALLETADJUSTED",
+		Amount: amount,
+		Wallet: wallet,
+		Reason: reason,
+	})
+	return wallet, true
+}
+
+// Ends the session as if the player sent ENDPLAY, false if not playing
+func (c *Client) ForceEndSession(ctx context.Context, actor string) (*EndPlayResultMessage, bool) {
+	result, _, ok := c.endSession(ctx, actor, "")
+	if !ok {
+		return nil, false
+	}
+
+	logging.FromContext(ctx).Info("Session ended by operator", slog.String("clientId", c.Id), slog.Int("profit", result.Profit), slog.String("actor", actor))
+
+	broadcastContext(ctx, []*Client{c}, result)
+	return result, true
+}
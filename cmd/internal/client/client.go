@@ -1,10 +1,16 @@
 package client
 
 import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"cgoncalveslck/dicegame/cmd/internal/tracing"
+	"context"
 	"encoding/json"
-	"fmt"
-	"log"
 	"log/slog"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,8 +18,13 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Version of the WebSocket messages, bumped when a change breaks clients
+const ProtocolVersion = 1
+
 const (
 	_ cError = iota
 	NO_BALANCE
@@ -27,11 +38,58 @@ const (
 	INVALID_CHOICE
 	UNKNOWN_KIND
 	CLIENT_NOT_FOUND
+	INVALID_NAME
+	NAME_TAKEN
+	INVALID_PROFILE
+	TABLE_FULL
+	ALREADY_SEATED
+	NOT_SEATED
+	BETTING_CLOSED
+	ALREADY_BET
+	INVALID_TABLE
+	INVALID_OPPONENT
+	DUEL_NOT_FOUND
+	TOURNAMENT_NOT_FOUND
+	TOURNAMENT_CLOSED
+	ALREADY_REGISTERED
+	NOT_REGISTERED
+	NO_ROLLS_LEFT
+	LOSS_LIMIT
+	WAGER_LIMIT
+	SESSION_TIME_LIMIT
+	COOLING_OFF
+	SELF_EXCLUDED
+	INVALID_LIMITS
+	REALITY_CHECK_PENDING
+	NO_REALITY_CHECK
+	RATE_LIMITED
+	TOO_MANY_DEVICES
+	INVALID_USERNAME
+	WEAK_PASSWORD
+	USERNAME_TAKEN
+	ACCOUNT_EXISTS
+	INVALID_CREDENTIALS
+	ACCOUNT_LOCKED
+	LOGIN_REQUIRED
+	FEATURE_DISABLED
+	IDEMPOTENCY_KEY_REUSED
 )
 
 type cError int
 
-const Timeout = 5 // 5min
+// Set from the configuration at startup
+var (
+	StartingBalance = 100              // wallet of a new client
+	HistorySize     = 10               // plays kept in a session's history
+	IdleTimeout     = 5 * time.Minute  // clients that send nothing for longer are removed from the store
+	IdleWarning     = 30 * time.Second // how long before that they're told, 0 for no warning
+)
+
+// Pushed IdleWarning before a client expires, any message keeps it
+type IdleWarningMessage struct {
+	Kind      string `json:"kind"`
+	ExpiresIn int    `json:"expiresIn"` // milliseconds
+}
 
 type EndPlayResultMessage struct {
 	Kind   string `json:"kind"`
@@ -40,20 +98,26 @@ type EndPlayResultMessage struct {
 }
 
 type PlayMessage struct {
-	Kind     string `json:"kind"`
-	ClientId string `json:"clientId"`
-	Bet      int    `json:"bet"`
-	Choice   string `json:"choice"`
+	Kind           string `json:"kind"`
+	ClientId       string `json:"clientId"`
+	Bet            int    `json:"bet"`
+	Choice         string `json:"choice"`
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 type PlayResultMessage struct {
-	Kind   string `json:"kind"`
-	Result string `json:"result"`
-	Roll   int    `json:"roll"`
+	Kind           string `json:"kind"`
+	Result         string `json:"result"`
+	Roll           int    `json:"roll"`
+	Jackpot        int    `json:"jackpot,omitempty"`      // won this play, already in the wallet
+	Contribution   int    `json:"contribution,omitempty"` // taken from the session profit for the jackpot
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	Replayed       bool   `json:"replayed,omitempty"` // a retry, this is the result the key got the first time
 }
 
 type StartSessionResultMessage struct {
-	Kind string `json:"kind"`
+	Kind  string       `json:"kind"`
+	Rules *rules.Rules `json:"rules"` // what this session plays by until ENDPLAY
 }
 
 type WalletResultMessage struct {
@@ -62,10 +126,11 @@ type WalletResultMessage struct {
 }
 
 type PlayHistoryItem struct {
-	Choice string `json:"choice"`
-	Bet    int    `json:"bet"`
-	Result string `json:"result"`
-	Roll   int    `json:"roll"`
+	Choice       string `json:"choice"`
+	Bet          int    `json:"bet"`
+	Result       string `json:"result"`
+	Roll         int    `json:"roll"`
+	RulesVersion string `json:"rulesVersion"`
 }
 
 type InfoResultMessage struct {
@@ -73,32 +138,70 @@ type InfoResultMessage struct {
 }
 
 type AuthResultMessage struct {
-	Kind     string `json:"kind"`
-	ClientId string `json:"clientId"`
+	Kind     string   `json:"kind"`
+	ClientId string   `json:"clientId"`
+	Profile  *Profile `json:"profile"`
 }
 
 type ErrorResultMessage struct {
-	Kind    string `json:"kind"`
-	Message string `json:"message"`
-	Code    cError `json:"code"`
+	Kind       string `json:"kind"`
+	Message    string `json:"message"`
+	Code       cError `json:"code"`
+	RetryAfter int    `json:"retryAfter,omitempty"` // milliseconds, RATE_LIMITED and ACCOUNT_LOCKED
 }
 
 type DefaultMessage struct {
-	ClientId string `json:"clientId"`
-	Kind     string `json:"kind"` // change to const maybe
-	Wallet   int    `json:"wallet"`
-	Bet      int    `json:"bet"`
-	Choice   string `json:"choice"`
+	ClientId     string       `json:"clientId"`
+	Kind         string       `json:"kind"` // change to const maybe
+	Wallet       int          `json:"wallet"`
+	Bet          int          `json:"bet"`
+	Choice       string       `json:"choice"`
+	DisplayName  string       `json:"displayName"`
+	Avatar       string       `json:"avatar"`
+	Preferences  *Preferences `json:"preferences"`
+	Table        string       `json:"table"`
+	Opponent     string       `json:"opponent"`
+	DuelId       string       `json:"duelId"`
+	Tournament   string       `json:"tournament"`
+	Limits       *Limits      `json:"limits"`
+	CoolOffHours int          `json:"coolOffHours"`
+	ExcludeDays  int          `json:"excludeDays"`
+	Kick         bool         `json:"kick"`
+	Username     string       `json:"username"`
+	Password     string       `json:"password"`
+	Token        string       `json:"token"`
+
+	IdempotencyKey string `json:"idempotencyKey"`
 }
 
 type Store struct {
 	// map[clientId]*Client
 	Clients map[string]*Client `json:"clients"`
-	Mx      *sync.Mutex        `json:"-"`
+	// map[tableId]*Table
+	Tables map[string]*Table `json:"-"`
+	// map[duelId]*Duel, only pending challenges
+	Duels map[string]*Duel `json:"-"`
+	// map[tournamentId]*Tournament, registering or running
+	Tournaments map[string]*Tournament `json:"-"`
+	// map[lowercase username]*Account
+	Accounts map[string]*Account `json:"-"`
+	// map[provider|subject]*Client
+	Identities map[string]*Client `json:"-"`
+	Jackpot    *Jackpot           `json:"jackpot"`
+	Mx         *sync.Mutex        `json:"-"`
+
+	loginTokens map[string]*loginToken // map[token]*loginToken, see IssueLoginToken
 }
 
 // Disconnects and removes a client from the store
-func (s *Store) DisconnectClient(c *Client) {
+func (s *Store) DisconnectClient(ctx context.Context, c *Client) {
+	// has to happen before locking the store, all of them lock it themselves
+	if t := c.SeatedAt(); t != nil {
+		t.Leave(c)
+	}
+	cancelDuelsOf(c)
+	c.settle(ctx, SettledDisconnected)
+
 	s.Mx.Lock()
 	defer s.Mx.Unlock()
 
@@ -108,14 +211,19 @@ func (s *Store) DisconnectClient(c *Client) {
 
 	client, ok := s.Clients[c.Id]
 	if ok {
-		if client.Conn != nil {
-			client.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			client.Conn.Close()
+		client.mx.Lock()
+		devices := client.Devices
+		client.Devices = nil
+		client.stopExpiry()
+		client.mx.Unlock()
+
+		for _, d := range devices {
+			d.Close(websocket.CloseNormalClosure, "")
 		}
 		delete(s.Clients, c.Id)
 	}
 
-	slog.Debug("Client removed", slog.String("ClientId", c.Id))
+	slog.Debug("Client removed", slog.String("clientId", c.Id))
 }
 
 func (s *Store) AddClient(c *Client) {
@@ -123,71 +231,185 @@ func (s *Store) AddClient(c *Client) {
 	defer s.Mx.Unlock()
 	s.Clients[c.Id] = c
 
-	slog.Debug("Client added", slog.String("ClientId", c.Id))
-}
-
-func SessionExpire() {
-	// i'm not sure if this is good practice
-	// i know about channels and contexts which i'm guessing are usually used for this
-	// my thought process is that this is supposed to keep running and if it isn't
-	// the server isn't either
-	// again, i'm still not sure about it but that's how i thought about it
-	// i'd gladly be corrected
-	timer := time.NewTicker(2 * time.Second)
-
-	for range timer.C {
-		// only doing this loop in the context of this project
-		// in a real product obviously we wouldn't do this
-		for _, c := range St.Clients {
-			if time.Now().Unix()-c.Last_seen > Timeout {
-				slog.Debug("expiring client")
-				St.DisconnectClient(c)
-			}
-		}
-	}
+	slog.Debug("Client added", slog.String("clientId", c.Id))
 }
 
 type Client struct {
-	Conn      *websocket.Conn `json:"-"`
-	Id        string          `json:"clientId"`
-	Wallet    int             `json:"wallet"`
-	Last_seen int64           `json:"-"`
-	Session   *Session        `json:"-"`
-	Ip        string          `json:"-"`
+	Devices   []*Device           `json:"-"`
+	Id        string              `json:"clientId"`
+	Wallet    int                 `json:"wallet"`
+	Profile   Profile             `json:"profile"`
+	Gambling  ResponsibleGambling `json:"responsibleGambling"`
+	Last_seen int64               `json:"-"`
+	Session   *Session            `json:"-"`
+	Table     *Table              `json:"-"`
+
+	account  *Account  // nil for guests, guarded by St.Mx
+	identity string    // provider|subject for identity logins, guarded by St.Mx
+	playKeys *playKeys // recent PLAY idempotency keys
+
+	// wallet, table seat, devices, session and profile
+	// the profile is also only written holding St.Mx, for unique names
+	mx sync.Mutex
+
+	expiry    *time.Timer // warns, then removes the client, restarted by Touch
+	expiryGen int         // bumped on every restart so a timer that already fired knows it's stale
+
+	settled *SettledMessage // a session the server ended while nobody was connected
 }
 
 func (c *Client) Init() {
 	c.Id = uuid.NewString()
-	c.Ip = c.Conn.RemoteAddr().String()
-	c.Wallet = 100
+	c.Wallet = StartingBalance
+	c.Profile = NewProfile(c.Id)
+	c.Touch()
+}
+
+// Marks the client as active and restarts its expiry, every device of a
+// client touches it
+// Only messages count, a connection that answers pings but sends nothing
+// still expires
+func (c *Client) Touch() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
 	c.Last_seen = time.Now().Unix()
+	// not a client yet, nothing to remove
+	if c.Id == "" {
+		return
+	}
+
+	c.stopExpiry()
+	gen, warning := c.expiryGen, IdleWarning
+	c.expiry = time.AfterFunc(IdleTimeout-warning, func() {
+		c.warnIdle(gen, warning)
+	})
+}
+
+// Caller must hold c.mx
+func (c *Client) stopExpiry() {
+	c.expiryGen++
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+}
+
+func (c *Client) warnIdle(gen int, warning time.Duration) {
+	c.mx.Lock()
+	// touched again while the timer was firing
+	if gen != c.expiryGen {
+		c.mx.Unlock()
+		return
+	}
+	c.expiry = time.AfterFunc(warning, func() {
+		c.expire(gen)
+	})
+	c.mx.Unlock()
+
+	if warning <= 0 {
+		return
+	}
+
+	err := c.SendMessage(&IdleWarningMessage{
+		Kind:      "IDLEWARNING",
+		ExpiresIn: int(warning.Milliseconds()),
+	})
+	if err != nil {
+		slog.Warn("SendMessage failed", slog.String("clientId", c.Id), slog.Any("error", err))
+	}
+}
+
+func (c *Client) expire(gen int) {
+	c.mx.Lock()
+	stale := gen != c.expiryGen
+	c.mx.Unlock()
+	if stale {
+		return
+	}
+
+	slog.Debug("Client expired", slog.String("clientId", c.Id))
+	c.settle(context.Background(), SettledExpired)
+	St.DisconnectClient(context.Background(), c)
 }
 
 func (c *Client) Disconnect() {
-	St.DisconnectClient(c)
+	St.DisconnectClient(context.Background(), c)
+}
+
+// Takes amount out of the wallet, false if there isn't enough
+// reason ends up in the audit log ("table_bet", "duel_stake", ...)
+func (c *Client) Debit(amount int, reason string) bool {
+	c.mx.Lock()
+	if amount > c.Wallet {
+		c.mx.Unlock()
+		return false
+	}
+	c.Wallet -= amount
+	balance := c.Wallet
+	c.mx.Unlock()
+
+	c.auditWallet(-amount, balance, reason)
+	return true
 }
 
-func (c *Client) HandleMessageErrors(cErr *ErrorResultMessage, err error, str string) {
+func (c *Client) Credit(amount int, reason string) {
+	c.mx.Lock()
+	c.Wallet += amount
+	balance := c.Wallet
+	c.mx.Unlock()
+
+	c.auditWallet(amount, balance, reason)
+}
+
+func (c *Client) auditWallet(amount, balance int, reason string) {
+	audit.Write(audit.Entry{
+		Event:    "wallet",
+		ClientId: c.Id,
+		Data: map[string]interface{}{
+			"amount":  amount,
+			"balance": balance,
+			"reason":  reason,
+		},
+	})
+}
+
+func (c *Client) Balance() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.Wallet
+}
+
+// Sends back whatever went wrong handling a message and marks the message's
+// span with it
+func (c *Client) HandleMessageErrors(ctx context.Context, cErr *ErrorResultMessage, err error, str string) {
+	span := trace.SpanFromContext(ctx)
+	log := logging.FromContext(ctx)
 	if err != nil {
-		log.Printf("%s error: %+v", str, err)
-		err := c.SendMessage(err)
+		log.Error(str+" failed", slog.Any("error", err))
+		tracing.Error(span, err)
+		err := c.SendMessageContext(ctx, err)
 		if err != nil {
-			log.Printf("SendMessage error: %+v", err)
+			log.Warn("SendMessage failed", slog.Any("error", err))
 		}
 	}
 	if cErr != nil {
-		err := c.SendErrorMessage(cErr)
+		tracing.ErrorCode(span, int(cErr.Code), cErr.Message)
+		err := c.SendMessageContext(ctx, cErr)
 		if err != nil {
-			log.Printf("SendErrorMessage error: %+v", err)
+			log.Warn("SendErrorMessage failed", slog.Any("error", err))
 			err = c.SendMessage(err)
 			if err != nil {
-				log.Printf("SendMessage error: %+v", err)
+				log.Warn("SendMessage failed", slog.Any("error", err))
 			}
 		}
 	}
 }
 
-func (c *Client) Play(msg *DefaultMessage) (*ErrorResultMessage, error) {
+func (c *Client) Play(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	ctx, span := tracing.Start(ctx, "Client.Play")
+	defer span.End()
+
 	if msg.Kind != "PLAY" || msg.ClientId == "" {
 		cError := &ErrorResultMessage{
 			Kind:    "ERROR",
@@ -198,8 +420,51 @@ func (c *Client) Play(msg *DefaultMessage) (*ErrorResultMessage, error) {
 		return cError, nil
 	}
 
+	// a retry of a play that already rolled gets the same ROLL back, even
+	// once the session is over
+	var key *playKey
+	var rolled *PlayResultMessage
+	if msg.IdempotencyKey != "" {
+		var replay *PlayResultMessage
+		var cErr *ErrorResultMessage
+		key, replay, cErr = c.claimKey(msg.IdempotencyKey, msg.Bet, msg.Choice)
+		if cErr != nil {
+			return cErr, nil
+		}
+
+		if replay != nil {
+			span.SetAttributes(attribute.Bool("play.replayed", true))
+			pResult := *replay
+			pResult.Replayed = true
+			err := c.SendMessageContext(ctx, pResult)
+			if err != nil {
+				return nil, err
+			}
+
+			logging.FromContext(ctx).Debug("Replayed Play", slog.String("idempotencyKey", msg.IdempotencyKey))
+			return nil, nil
+		}
+
+		defer func() {
+			c.finishKey(key, rolled)
+		}()
+	}
+
+	// the session is read once, other devices and the reality check timer
+	// use it too
+	c.mx.Lock()
+	s := c.Session
+	playing := s != nil && s.Playing
+	var pending bool
+	var r *rules.Rules
+	if playing {
+		pending = s.AwaitingAck
+		r = s.Rules
+	}
+	c.mx.Unlock()
+
 	// needs to start a session/round first
-	if c.Session == nil {
+	if !playing {
 		cErr := &ErrorResultMessage{
 			Kind:    "ERROR",
 			Message: "Attemped to play without session",
@@ -209,70 +474,149 @@ func (c *Client) Play(msg *DefaultMessage) (*ErrorResultMessage, error) {
 		return cErr, nil
 	}
 
+	if pending {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Acknowledge the reality check first",
+			Code:    REALITY_CHECK_PENDING,
+		}
+
+		return cErr, nil
+	}
+
 	var p *PlayMessage
-	p, cErr := c.ValidatePlay(msg)
+	p, cErr := c.ValidatePlay(msg, r)
 	if cErr != nil {
 		return cErr, nil
 	}
+	bet, _ := r.Bet(p.Choice)
 
-	// should get 0 to 5 so +1
-	// implement DDA for fun?
-	num := rand.Intn(6) + 1
+	num := rollDice()
 
-	var win bool
-	switch p.Choice {
-	case "ODD":
-		// this should be correct and faster but i didn't check
-		win = num&1 != 0
-	case "EVEN":
-		win = num&1 == 0
+	var res string
+	c.mx.Lock()
+	// another device ended it, or the server did, while this play was checked
+	if c.Session != s || !s.Playing {
+		c.mx.Unlock()
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Not playing",
+			Code:    NOT_PLAYING,
+		}
+
+		return cErr, nil
 	}
 
-	var res string
-	if win {
-		c.Session.Profit += p.Bet
+	s.Plays++
+	if rules.Wins(p.Choice, num) {
+		s.Profit += p.Bet * bet.Pays
 		res = "WIN"
 	} else {
-		c.Session.Profit -= p.Bet
+		s.Profit -= p.Bet
 		res = "LOSE"
 	}
-
-	pResult := PlayResultMessage{
-		Kind:   "ROLL",
-		Result: res,
-		Roll:   num,
+	s.PlayHistory.Add(PlayHistoryItem{
+		Choice:       p.Choice,
+		Bet:          p.Bet,
+		Result:       res,
+		Roll:         num,
+		RulesVersion: r.Version,
+	})
+	// the jackpot is fed from the stake, only once the play is sure to count
+	contribution := 0
+	streak := false
+	if r.Features.Jackpot {
+		contribution = St.Jackpot.Contribute(p.Bet)
+		s.Profit -= contribution
+		streak = s.countSix(num)
+	}
+	c.mx.Unlock()
+	span.SetAttributes(
+		attribute.Int("play.bet", p.Bet),
+		attribute.String("play.choice", p.Choice),
+		attribute.Int("play.roll", num),
+		attribute.String("play.result", res),
+		attribute.String("rules.version", r.Version),
+	)
+
+	metrics.Plays.WithLabelValues(p.Choice, res).Inc()
+	metrics.Wager(p.Bet)
+	if res == "WIN" {
+		// stake back plus the winnings, like a table pays
+		metrics.Payout(p.Bet * (bet.Pays + 1))
+		c.recordBet(p.Bet, p.Bet*bet.Pays-contribution)
+	} else {
+		c.recordBet(p.Bet, -p.Bet-contribution)
 	}
 
-	PlayHistoryItem := PlayHistoryItem{
-		Choice: p.Choice,
-		Bet:    p.Bet,
-		Result: res,
-		Roll:   num,
-	}
+	pResult := PlayResultMessage{
+		Kind:           "ROLL",
+		Result:         res,
+		Roll:           num,
+		Contribution:   contribution,
+		IdempotencyKey: msg.IdempotencyKey,
+	}
+	if streak {
+		pResult.Jackpot = c.winJackpot(ctx)
+	}
+	rolled = &pResult
+
+	audit.WriteContext(ctx, audit.Entry{
+		Event:    "play",
+		ClientId: c.Id,
+		Data: map[string]interface{}{
+			"bet":          p.Bet,
+			"choice":       p.Choice,
+			"roll":         num,
+			"result":       res,
+			"jackpot":      pResult.Jackpot,
+			"contribution": contribution,
+			"rules":        r.Version,
+		},
+	})
 
-	c.Session.PlayHistory.Add(PlayHistoryItem)
-	err := c.SendMessage(pResult)
+	err := c.SendMessageContext(ctx, pResult)
 	if err != nil {
 		return nil, err
 	}
 
-	slog.Debug("Completed Play", slog.String("id", c.Id), slog.Int("wallet", c.Wallet), slog.String("choice", p.Choice), slog.Int("bet", p.Bet), slog.String("result", res), slog.Int("roll", num))
+	logging.FromContext(ctx).Debug("Completed Play", slog.Int("wallet", c.Balance()), slog.String("choice", p.Choice), slog.Int("bet", p.Bet), slog.String("result", res), slog.Int("roll", num))
 	return nil, nil
 }
 
-func (c *Client) ValidatePlay(msg *DefaultMessage) (pMsg *PlayMessage, cErr *ErrorResultMessage) {
+func rollDice() int {
+	// should get 0 to 5 so +1
+	// implement DDA for fun?
+	return rand.Intn(6) + 1
+}
+
+// For entry points the current rules switched off
+func featureDisabled(name string) *ErrorResultMessage {
+	return &ErrorResultMessage{
+		Kind:    "ERROR",
+		Message: name + " are disabled",
+		Code:    FEATURE_DISABLED,
+	}
+}
+
+// Checks msg against the balance, the player's limits and r
+func (c *Client) ValidatePlay(msg *DefaultMessage, r *rules.Rules) (pMsg *PlayMessage, cErr *ErrorResultMessage) {
 	var eMessage string
 	var code cError
 
+	_, enabled := r.Bet(msg.Choice)
 	switch {
-	case msg.Bet > c.Wallet:
+	case msg.Bet > c.Balance():
 		eMessage = "Insufficient points"
 		code = NO_BALANCE
-	case msg.Bet < 1:
-		eMessage = "Invalid bet"
+	case msg.Bet < r.MinBet:
+		eMessage = "Invalid bet (minimum " + strconv.Itoa(r.MinBet) + ")"
+		code = INVALID_BET
+	case r.MaxBet > 0 && msg.Bet > r.MaxBet:
+		eMessage = "Invalid bet (maximum " + strconv.Itoa(r.MaxBet) + ")"
 		code = INVALID_BET
-	case msg.Choice != "ODD" && msg.Choice != "EVEN":
-		eMessage = "Invalid choice (ODD or EVEN)"
+	case !enabled:
+		eMessage = "Invalid choice (" + strings.Join(r.Choices(), " or ") + ")"
 		code = INVALID_CHOICE
 	}
 
@@ -285,6 +629,11 @@ func (c *Client) ValidatePlay(msg *DefaultMessage) (pMsg *PlayMessage, cErr *Err
 		return
 	}
 
+	cErr = c.checkLimits(msg.Bet)
+	if cErr != nil {
+		return
+	}
+
 	pMsg = &PlayMessage{
 		Bet:    msg.Bet,
 		Choice: msg.Choice,
@@ -292,40 +641,57 @@ func (c *Client) ValidatePlay(msg *DefaultMessage) (pMsg *PlayMessage, cErr *Err
 	return
 }
 
-func (c *Client) Auth(conn *websocket.Conn) (*Client, error) {
-	if c.Id == "" {
-		c.Init()
-		St.AddClient(c)
-
-		c.SendMessage(&AuthResultMessage{
-			Kind:     "AUTH",
-			ClientId: c.Id,
+// Gives d a client, either a new one or an existing one when msg has a
+// clientId, in which case d becomes one more device of that client
+// Registered and identity clients also need the token from an HTTP login
+func (c *Client) Auth(ctx context.Context, d *Device, msg *DefaultMessage) (*Client, error) {
+	// this connection already belongs to a client
+	if c.Id != "" {
+		err := d.SendMessageContext(ctx, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "already logged",
+			Code:    ALREADY_LOGGED,
 		})
+		return c, err
+	}
 
-		return c, nil
+	if msg.ClientId != "" {
+		return c.loginDevice(ctx, d, msg), nil
 	}
 
-	addr := conn.RemoteAddr().String()
-	// this is a bit RAW and ROUGH but you get the point
-	// only doing this loop in the context of this project
-	// in a real product obviously we wouldn't do this
-	for _, c := range St.Clients {
-		if c.Ip == addr {
-			err := c.SendMessage(&ErrorResultMessage{
-				Kind:    "ERROR",
-				Message: "already logged",
-				Code:    ALREADY_LOGGED,
-			})
-			if err != nil {
-				log.Printf("SendErrorMessage error: %+v", err)
-			}
-			return c, nil
-		}
+	if !AllowGuests {
+		err := d.SendMessageContext(ctx, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "guests are disabled, log in first",
+			Code:    LOGIN_REQUIRED,
+		})
+		return c, err
 	}
-	return c, nil
+
+	c.Init()
+	St.AddClient(c)
+
+	audit.WriteContext(ctx, audit.Entry{
+		Event:    "auth",
+		ClientId: c.Id,
+		Data: map[string]interface{}{
+			"device": d.Id,
+			"ip":     d.Ip,
+			"wallet": c.Wallet,
+		},
+	})
+
+	profile := c.ProfileSnapshot()
+	err := c.SendMessageContext(ctx, &AuthResultMessage{
+		Kind:     "AUTH",
+		ClientId: c.Id,
+		Profile:  &profile,
+	})
+
+	return c, err
 }
 
-func (c *Client) GetWallet(msg *DefaultMessage) (*ErrorResultMessage, error) {
+func (c *Client) GetWallet(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
 	if msg.Kind != "WALLET" || msg.ClientId == "" {
 		cError := &ErrorResultMessage{
 			Kind:    "ERROR",
@@ -338,20 +704,20 @@ func (c *Client) GetWallet(msg *DefaultMessage) (*ErrorResultMessage, error) {
 
 	wMessage := WalletResultMessage{
 		Kind:   "WALLET",
-		Wallet: c.Wallet,
+		Wallet: c.Balance(),
 	}
 
-	err := c.SendMessage(wMessage)
+	err := c.SendMessageContext(ctx, wMessage)
 	if err != nil {
-		slog.Error("GetWallet: Failed to send WalletResultMessage")
+		logging.FromContext(ctx).Error("GetWallet: Failed to send WalletResultMessage")
 		return nil, err
 	}
 
-	slog.Debug("GetWallet", slog.String("id", c.Id), slog.Int("wallet", c.Wallet))
+	logging.FromContext(ctx).Debug("GetWallet", slog.Int("wallet", c.Balance()))
 	return nil, nil
 }
 
-func (c *Client) StartSession(msg *DefaultMessage) (*ErrorResultMessage, error) {
+func (c *Client) StartSession(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
 	if msg.ClientId == "" || msg.Kind != "STARTPLAY" {
 		cError := &ErrorResultMessage{
 			Kind:    "ERROR",
@@ -362,7 +728,15 @@ func (c *Client) StartSession(msg *DefaultMessage) (*ErrorResultMessage, error)
 		return cError, nil
 	}
 
+	if cErr := c.checkBlocked(); cErr != nil {
+		return cErr, nil
+	}
+
+	r := rules.Current()
+	// checked and started under one lock, two devices can't both start one
+	c.mx.Lock()
 	if c.Session != nil && c.Session.Playing {
+		c.mx.Unlock()
 		cError := &ErrorResultMessage{
 			Kind:    "ERROR",
 			Message: "Already playing",
@@ -373,25 +747,32 @@ func (c *Client) StartSession(msg *DefaultMessage) (*ErrorResultMessage, error)
 	}
 
 	c.Session = &Session{
-		Playing: true,
-		Profit:  0,
+		Playing:   true,
+		Profit:    0,
+		StartedAt: time.Now(),
+		Rules:     r,
 		PlayHistory: &PlayHistory{
 			Items: make([]PlayHistoryItem, 0),
 		},
 	}
+	c.scheduleRealityCheck(c.Session)
+	c.mx.Unlock()
+
+	audit.WriteContext(ctx, audit.Entry{Event: "session_start", ClientId: c.Id, Data: map[string]interface{}{"rules": r.Version}})
 
-	err := c.SendMessage(&StartSessionResultMessage{
-		Kind: "STARTPLAY",
+	err := c.SendMessageContext(ctx, &StartSessionResultMessage{
+		Kind:  "STARTPLAY",
+		Rules: r,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	slog.Debug("Session started", slog.String("id", c.Id))
+	logging.FromContext(ctx).Debug("Session started", slog.String("rules", r.Version))
 	return nil, nil
 }
 
-func (c *Client) EndSession(msg *DefaultMessage) (*ErrorResultMessage, error) {
+func (c *Client) EndSession(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
 	if msg.ClientId == "" || msg.Kind != "ENDPLAY" {
 		cError := &ErrorResultMessage{
 			Kind:    "ERROR",
@@ -402,7 +783,10 @@ func (c *Client) EndSession(msg *DefaultMessage) (*ErrorResultMessage, error) {
 		return cError, nil
 	}
 
-	if c.Session == nil {
+	c.mx.Lock()
+	started := c.Session != nil
+	c.mx.Unlock()
+	if !started {
 		cErr := &ErrorResultMessage{
 			Kind:    "ERROR",
 			Message: "Attemped to end session without session",
@@ -412,7 +796,8 @@ func (c *Client) EndSession(msg *DefaultMessage) (*ErrorResultMessage, error) {
 		return cErr, nil
 	}
 
-	if !c.Session.Playing {
+	result, _, ok := c.endSession(ctx, "", "")
+	if !ok {
 		cError := &ErrorResultMessage{
 			Kind:    "ERROR",
 			Message: "Not playing",
@@ -421,40 +806,126 @@ func (c *Client) EndSession(msg *DefaultMessage) (*ErrorResultMessage, error) {
 		return cError, nil
 	}
 
-	newBalance := c.Wallet + c.Session.Profit
-	c.Wallet = newBalance
+	err := c.SendMessageContext(ctx, result)
+	if err != nil {
+		return nil, err
+	}
 
-	err := c.SendMessage(&EndPlayResultMessage{
+	logging.FromContext(ctx).Debug("Session ended")
+	return nil, nil
+}
+
+// Settles the session profit into the wallet and resets the session, also
+// returns the plays of the session
+// All under one lock so the profit can't be paid twice, false if there was
+// nothing to end
+// actor is empty when the player ended it, reason is empty unless the
+// server ended it (see settle)
+func (c *Client) endSession(ctx context.Context, actor, reason string) (*EndPlayResultMessage, []PlayHistoryItem, bool) {
+	c.mx.Lock()
+	if c.Session == nil || !c.Session.Playing {
+		c.mx.Unlock()
+		return nil, nil, false
+	}
+
+	c.Wallet += c.Session.Profit
+	result := &EndPlayResultMessage{
 		Kind:   "ENDPLAY",
 		Profit: c.Session.Profit,
 		Wallet: c.Wallet,
+	}
+	plays := c.Session.Plays
+	// Reset drops the history, the items themselves aren't changed
+	history := c.Session.PlayHistory.Items
+	c.Session.Reset()
+	c.mx.Unlock()
+
+	data := map[string]interface{}{
+		"profit": result.Profit,
+		"wallet": result.Wallet,
+		"plays":  plays,
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	audit.WriteContext(ctx, audit.Entry{
+		Event:    "session_end",
+		ClientId: c.Id,
+		Actor:    actor,
+		Data:     data,
 	})
-	if err != nil {
-		return nil, err
+	return result, history, true
+}
+
+// Counts error replies for the metrics, every send path goes through here
+func countError(msg interface{}) {
+	if cErr, ok := msg.(*ErrorResultMessage); ok {
+		metrics.Errors.WithLabelValues(strconv.Itoa(int(cErr.Code))).Inc()
 	}
+}
 
-	c.Session.Reset()
-	slog.Debug("Session ended", slog.String("id", c.Id))
-	return nil, nil
+// Clients and running sessions, for the metrics
+func (c *Client) Playing() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.Session != nil && c.Session.Playing
+}
+
+func (s *Store) Counts() (clients, sessions int) {
+	s.Mx.Lock()
+	all := make([]*Client, 0, len(s.Clients))
+	for _, c := range s.Clients {
+		all = append(all, c)
+	}
+	s.Mx.Unlock()
+
+	for _, c := range all {
+		c.mx.Lock()
+		if c.Session != nil && c.Session.Playing {
+			sessions++
+		}
+		c.mx.Unlock()
+	}
+	return len(all), sessions
 }
 
 func (c *Client) SendMessage(msg interface{}) error {
+	countError(msg)
 	data, err := json.Marshal(msg)
 	if err != nil {
-		fmt.Println("Error marshalling message", err)
+		slog.Error("Marshalling message failed", slog.String("clientId", c.Id), slog.Any("error", err))
 		return err
 	}
 
-	err = c.Conn.WriteMessage(websocket.TextMessage, data)
-	if err != nil {
-		fmt.Println("Error sending message", err)
+	// every device of the client sees the same thing, it only fails
+	// when none of them got it
+	devices := c.devices()
+	err = nil
+	sent := 0
+	for _, d := range devices {
+		if e := d.send(data); e != nil {
+			d.Log().Warn("Sending message failed", slog.Any("error", e))
+			err = e
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && err != nil {
 		return err
 	}
-
-	slog.Debug("Sent message", slog.String("client", c.Id), slog.String("message", string(data)))
 	return nil
 }
 
+// SendMessage under its own span when ctx is traced
+func (c *Client) SendMessageContext(ctx context.Context, msg interface{}) error {
+	_, span := tracing.StartChild(ctx, "Client.SendMessage", trace.WithAttributes(attribute.Int("devices", len(c.devices()))))
+	defer span.End()
+
+	err := c.SendMessage(msg)
+	tracing.Error(span, err)
+	return err
+}
+
 func (c *Client) SendErrorMessage(cErr *ErrorResultMessage) error {
 	err := c.SendMessage(cErr)
 	if err != nil {
@@ -470,32 +941,56 @@ type PlayHistory struct {
 }
 
 func (ph *PlayHistory) Add(item PlayHistoryItem) {
-	if len(ph.Items) == 10 {
-		ph.Items = ph.Items[1:]
+	if len(ph.Items) >= HistorySize {
+		ph.Items = ph.Items[len(ph.Items)-HistorySize+1:]
 	}
 	ph.Items = append(ph.Items, item)
 
-	slog.Debug("PlayHistory: Added item", slog.String("choice", item.Choice), slog.Int("bet", item.Bet), slog.String("result", item.Result), slog.Int("roll", item.Roll))
+	slog.Debug("PlayHistory: Added item", slog.String("choice", item.Choice), slog.Int("bet", item.Bet), slog.String("result", item.Result), slog.Int("roll", item.Roll), slog.String("rules", item.RulesVersion))
 }
 
 type Session struct {
 	Playing     bool // might be redundant atm
 	Profit      int  // should always be 0 if not playing
 	PlayHistory *PlayHistory
+	Sixes       int // current streak of sixes, for the jackpot
+	StartedAt   time.Time
+	Plays       int
+	AwaitingAck bool         // a reality check was pushed and not acknowledged yet
+	Rules       *rules.Rules // the ones current at STARTPLAY, reloads don't change them
+
+	realityTimer *time.Timer
 }
 
 func (s *Session) Reset() {
 	s.PlayHistory = nil
 	s.Profit = 0
 	s.Playing = false
+	s.Sixes = 0
+	s.Plays = 0
+	s.AwaitingAck = false
+	if s.realityTimer != nil {
+		s.realityTimer.Stop()
+		s.realityTimer = nil
+	}
 }
 
 var St = &Store{
-	Clients: make(map[string]*Client),
-	Mx:      &sync.Mutex{},
+	Clients:     make(map[string]*Client),
+	Tables:      make(map[string]*Table),
+	Duels:       make(map[string]*Duel),
+	Tournaments: make(map[string]*Tournament),
+	Accounts:    make(map[string]*Account),
+	Identities:  make(map[string]*Client),
+	Jackpot:     &Jackpot{Pool: JackpotSeed},
+	Mx:          &sync.Mutex{},
+	loginTokens: make(map[string]*loginToken),
 }
 
-func HandleClientID(conn *websocket.Conn, msg *DefaultMessage) *ErrorResultMessage {
+func HandleClientID(ctx context.Context, conn *websocket.Conn, msg *DefaultMessage) *ErrorResultMessage {
+	ctx, span := tracing.Start(ctx, "HandleClientID", trace.WithAttributes(tracing.ClientID(msg.ClientId)))
+	defer span.End()
+
 	_, err := uuid.Parse(msg.ClientId)
 	if err != nil {
 		return &ErrorResultMessage{
@@ -505,7 +1000,12 @@ func HandleClientID(conn *websocket.Conn, msg *DefaultMessage) *ErrorResultMessa
 		}
 	}
 
+	_, lookup := tracing.Start(ctx, "Store.Clients")
+	St.Mx.Lock()
 	_, ok := St.Clients[msg.ClientId]
+	St.Mx.Unlock()
+	lookup.SetAttributes(attribute.Bool("found", ok))
+	lookup.End()
 	if !ok {
 		return &ErrorResultMessage{
 			Kind:    "ERROR",
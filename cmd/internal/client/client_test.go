@@ -1,20 +1,49 @@
 package client_test
 
 import (
+	"bytes"
 	"cgoncalveslck/dicegame/cmd/internal/client"
 	"cgoncalveslck/dicegame/cmd/internal/handlers"
+	"cgoncalveslck/dicegame/cmd/internal/identity"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/round"
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthMessage struct {
-	Kind string `json:"kind"`
+	Kind     string `json:"kind"`
+	ClientId string `json:"clientId,omitempty"`
+	Kick     bool   `json:"kick,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+type AccountMessage struct {
+	Kind     string `json:"kind"`
+	ClientId string `json:"clientId,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type WalletMessage struct {
@@ -610,3 +639,2530 @@ func TestGetWallet(t *testing.T) {
 		t.Errorf("Expected Balance but got 0")
 	}
 }
+
+type ProfileMessage struct {
+	Kind        string              `json:"kind"`
+	ClientId    string              `json:"clientId"`
+	DisplayName string              `json:"displayName,omitempty"`
+	Avatar      string              `json:"avatar,omitempty"`
+	Preferences *client.Preferences `json:"preferences,omitempty"`
+}
+
+// opens a second connection and authenticates it
+func dialAndAuth(t *testing.T) (*websocket.Conn, *client.AuthResultMessage) {
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	err = conn.WriteJSON(&AuthMessage{Kind: "AUTH"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	authRM := &client.AuthResultMessage{}
+	err = conn.ReadJSON(authRM)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	return conn, authRM
+}
+
+func TestAuthProfile(t *testing.T) {
+	conn, authRM := dialAndAuth(t)
+	defer conn.Close()
+
+	if authRM.Profile == nil {
+		t.Fatalf("Expected Profile but got nil")
+	}
+
+	if authRM.Profile.DisplayName == "" {
+		t.Errorf("Expected default DisplayName but got empty string")
+	}
+
+	if authRM.Profile.CreatedAt.IsZero() {
+		t.Errorf("Expected CreatedAt but got zero time")
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	pMsg := &ProfileMessage{
+		Kind:        "PROFILE",
+		ClientId:    validUUID,
+		DisplayName: "Lucky_Seven",
+		Avatar:      "dice-red",
+		Preferences: &client.Preferences{Sound: true, Theme: "dark"},
+	}
+
+	err := ws.WriteJSON(pMsg)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	prM := &client.ProfileResultMessage{}
+	err = ws.ReadJSON(prM)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	if prM.Kind != "PROFILE" {
+		t.Errorf("Expected PROFILE as Kind but got %s", prM.Kind)
+	}
+
+	if prM.Profile.DisplayName != "Lucky_Seven" {
+		t.Errorf("Expected Lucky_Seven as DisplayName but got %s", prM.Profile.DisplayName)
+	}
+
+	if prM.Profile.Avatar != "dice-red" {
+		t.Errorf("Expected dice-red as Avatar but got %s", prM.Profile.Avatar)
+	}
+
+	if !prM.Profile.Preferences.Sound || prM.Profile.Preferences.Theme != "dark" {
+		t.Errorf("Expected updated Preferences but got %+v", prM.Profile.Preferences)
+	}
+}
+
+func TestInvalidDisplayName(t *testing.T) {
+	pMsg := &ProfileMessage{
+		Kind:        "PROFILE",
+		ClientId:    validUUID,
+		DisplayName: "no spaces allowed",
+	}
+
+	err := ws.WriteJSON(pMsg)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	err = ws.ReadJSON(cErr)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	if cErr.Kind != "ERROR" {
+		t.Errorf("Expected ERROR as Kind but got %s", cErr.Kind)
+	}
+
+	if cErr.Code != client.INVALID_NAME {
+		t.Errorf("Expected INVALID_NAME as Code but got %d", cErr.Code)
+	}
+}
+
+func TestDisplayNameTaken(t *testing.T) {
+	conn, authRM := dialAndAuth(t)
+	defer conn.Close()
+
+	pMsg := &ProfileMessage{
+		Kind:        "PROFILE",
+		ClientId:    authRM.ClientId,
+		DisplayName: "lucky_seven",
+	}
+
+	err := conn.WriteJSON(pMsg)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	err = conn.ReadJSON(cErr)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	if cErr.Kind != "ERROR" {
+		t.Errorf("Expected ERROR as Kind but got %s", cErr.Kind)
+	}
+
+	if cErr.Code != client.NAME_TAKEN {
+		t.Errorf("Expected NAME_TAKEN as Code but got %d", cErr.Code)
+	}
+}
+
+type TableMessage struct {
+	Kind     string `json:"kind"`
+	ClientId string `json:"clientId"`
+	Table    string `json:"table,omitempty"`
+	Bet      int    `json:"bet,omitempty"`
+	Choice   string `json:"choice,omitempty"`
+}
+
+// reads messages until one of the given kind shows up, skipping broadcasts
+// that can arrive in between
+func readUntil(t *testing.T, conn *websocket.Conn, kind string, v interface{}) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Waiting for %s: Error: %+v", kind, err)
+		}
+
+		msg := &AuthMessage{}
+		err = json.Unmarshal(data, msg)
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+
+		if msg.Kind == kind {
+			err = json.Unmarshal(data, v)
+			if err != nil {
+				t.Fatalf("Error: %+v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestTableSharedRoll(t *testing.T) {
+	client.TableRounds = round.Config{
+		Betting: 300 * time.Millisecond,
+		Tick:    100 * time.Millisecond,
+	}
+
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	for _, p := range []struct {
+		conn *websocket.Conn
+		id   string
+	}{{p1, a1.ClientId}, {p2, a2.ClientId}} {
+		err := p.conn.WriteJSON(&TableMessage{Kind: "JOIN", ClientId: p.id, Table: "shared"})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+
+		jMsg := &client.JoinTableResultMessage{}
+		readUntil(t, p.conn, "JOIN", jMsg)
+		if jMsg.Table != "shared" {
+			t.Errorf("Expected shared as Table but got %s", jMsg.Table)
+		}
+	}
+
+	// wait for a fresh window so both bets land in the same round
+	open := &client.BettingOpenMessage{}
+	readUntil(t, p1, "BETTINGOPEN", open)
+	readUntil(t, p2, "BETTINGOPEN", open)
+
+	err := p1.WriteJSON(&TableMessage{Kind: "BET", ClientId: a1.ClientId, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	err = p2.WriteJSON(&TableMessage{Kind: "BET", ClientId: a2.ClientId, Bet: 20, Choice: "EVEN"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	bMsg := &client.TableBetResultMessage{}
+	readUntil(t, p1, "BET", bMsg)
+	if bMsg.Wallet != 90 {
+		t.Errorf("Expected stake to leave the wallet (90) but got %d", bMsg.Wallet)
+	}
+
+	r1 := &client.TableRollMessage{}
+	readUntil(t, p1, "TABLEROLL", r1)
+	r2 := &client.TableRollMessage{}
+	readUntil(t, p2, "TABLEROLL", r2)
+
+	if r1.Roll != r2.Roll || r1.Roll < 1 || r1.Roll > 6 {
+		t.Errorf("Expected the same roll for both players but got %d and %d", r1.Roll, r2.Roll)
+	}
+
+	if len(r1.Results) != 2 {
+		t.Fatalf("Expected 2 results but got %d", len(r1.Results))
+	}
+
+	// exactly one of ODD/EVEN wins
+	wins := 0
+	for _, res := range r1.Results {
+		if res.Result == "WIN" {
+			wins++
+		}
+	}
+	if wins != 1 {
+		t.Errorf("Expected exactly one winner but got %d", wins)
+	}
+
+	err = p1.WriteJSON(&TableMessage{Kind: "LEAVE", ClientId: a1.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	lMsg := &client.LeaveTableResultMessage{}
+	readUntil(t, p1, "LEAVE", lMsg)
+	if lMsg.Table != "shared" {
+		t.Errorf("Expected shared as Table but got %s", lMsg.Table)
+	}
+}
+
+func TestTableLeaveWhileLocked(t *testing.T) {
+	client.TableRounds = round.Config{
+		Betting: 300 * time.Millisecond,
+		Locked:  time.Second,
+	}
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	err := conn.WriteJSON(&TableMessage{Kind: "JOIN", ClientId: a.ClientId, Table: "locked"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "JOIN", &client.JoinTableResultMessage{})
+	readUntil(t, conn, "BETTINGOPEN", &client.BettingOpenMessage{})
+
+	err = conn.WriteJSON(&TableMessage{Kind: "BET", ClientId: a.ClientId, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "BET", &client.TableBetResultMessage{})
+	readUntil(t, conn, "BETSLOCKED", &client.BetsLockedMessage{})
+
+	err = conn.WriteJSON(&TableMessage{Kind: "LEAVE", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	lMsg := &client.LeaveTableResultMessage{}
+	readUntil(t, conn, "LEAVE", lMsg)
+	if lMsg.Refund != 10 {
+		t.Errorf("Expected the locked bet refunded (10) but got %d", lMsg.Refund)
+	}
+
+	if w := getWallet(t, conn, a.ClientId); w != 100 {
+		t.Errorf("Expected wallet 100 but got %d", w)
+	}
+}
+
+func TestTableJoinClosesIn(t *testing.T) {
+	client.TableRounds = round.Config{
+		Betting: 1500 * time.Millisecond,
+		Locked:  2500 * time.Millisecond,
+	}
+
+	join := func(conn *websocket.Conn, id string) *client.JoinTableResultMessage {
+		err := conn.WriteJSON(&TableMessage{Kind: "JOIN", ClientId: id, Table: "closing"})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		jMsg := &client.JoinTableResultMessage{}
+		readUntil(t, conn, "JOIN", jMsg)
+		return jMsg
+	}
+
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	join(p1, a1.ClientId)
+	readUntil(t, p1, "BETTINGOPEN", &client.BettingOpenMessage{})
+
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+	if jMsg := join(p2, a2.ClientId); !jMsg.BettingOpen || jMsg.ClosesIn < 0 || jMsg.ClosesIn > 1 {
+		t.Errorf("Expected betting open closing within 1s but got %+v", jMsg)
+	}
+
+	// well into the locked phase, the betting phase ended over a second ago
+	readUntil(t, p1, "BETSLOCKED", &client.BetsLockedMessage{})
+	time.Sleep(1100 * time.Millisecond)
+
+	p3, a3 := dialAndAuth(t)
+	defer p3.Close()
+	if jMsg := join(p3, a3.ClientId); jMsg.BettingOpen || jMsg.ClosesIn != 0 {
+		t.Errorf("Expected betting closed with no countdown but got %+v", jMsg)
+	}
+
+	for _, p := range []struct {
+		conn *websocket.Conn
+		id   string
+	}{{p1, a1.ClientId}, {p2, a2.ClientId}, {p3, a3.ClientId}} {
+		err := p.conn.WriteJSON(&TableMessage{Kind: "LEAVE", ClientId: p.id})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		readUntil(t, p.conn, "LEAVE", &client.LeaveTableResultMessage{})
+	}
+}
+
+func TestTableJoinFromDevices(t *testing.T) {
+	phone, authRM := dialAndAuth(t)
+	defer phone.Close()
+
+	devices := []*websocket.Conn{phone}
+	for i := 0; i < 3; i++ {
+		conn := dialDevice(t, authRM.ClientId, false)
+		defer conn.Close()
+		readUntil(t, conn, "AUTH", &client.AuthResultMessage{})
+		devices = append(devices, conn)
+	}
+
+	// well within the per client rate limit
+	for i := 0; i < 10; i++ {
+		tables := make([]string, len(devices))
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j, conn := range devices {
+			tables[j] = fmt.Sprintf("dup-%d-%d", i, j)
+			wg.Add(1)
+			go func(conn *websocket.Conn, table string) {
+				defer wg.Done()
+				<-start
+				err := conn.WriteJSON(&TableMessage{Kind: "JOIN", ClientId: authRM.ClientId, Table: table})
+				if err != nil {
+					t.Errorf("Error: %+v", err)
+				}
+			}(conn, tables[j])
+		}
+		close(start)
+		wg.Wait()
+
+		// every reply goes to every device, one JOIN and the rest refused
+		joined, refused := 0, 0
+		phone.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for joined+refused < len(devices) {
+			_, data, err := phone.ReadMessage()
+			if err != nil {
+				t.Fatalf("Error: %+v", err)
+			}
+			reply := &client.ErrorResultMessage{}
+			json.Unmarshal(data, reply)
+			switch {
+			case reply.Kind == "JOIN":
+				joined++
+			case reply.Kind == "ERROR" && reply.Code == client.ALREADY_SEATED:
+				refused++
+			}
+		}
+		phone.SetReadDeadline(time.Time{})
+		if joined != 1 {
+			t.Fatalf("Expected one JOIN and %d ALREADY_SEATED but got %d and %d", len(devices)-1, joined, refused)
+		}
+
+		// the refused JOINs left no table behind
+		client.St.Mx.Lock()
+		open := 0
+		for _, id := range tables {
+			if _, ok := client.St.Tables[id]; ok {
+				open++
+			}
+		}
+		client.St.Mx.Unlock()
+		if open != 1 {
+			t.Fatalf("Expected the client at one of %v but %d are open", tables, open)
+		}
+
+		err := phone.WriteJSON(&TableMessage{Kind: "LEAVE", ClientId: authRM.ClientId})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		readUntil(t, phone, "LEAVE", &client.LeaveTableResultMessage{})
+	}
+}
+
+func TestTableBetNotSeated(t *testing.T) {
+	err := ws.WriteJSON(&TableMessage{Kind: "BET", ClientId: validUUID, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	err = ws.ReadJSON(cErr)
+	if err != nil {
+		t.Errorf("Error: %+v", err)
+	}
+
+	if cErr.Code != client.NOT_SEATED {
+		t.Errorf("Expected NOT_SEATED as Code but got %d", cErr.Code)
+	}
+}
+
+type DuelMessage struct {
+	Kind     string `json:"kind"`
+	ClientId string `json:"clientId"`
+	Opponent string `json:"opponent,omitempty"`
+	Bet      int    `json:"bet,omitempty"`
+	DuelId   string `json:"duelId,omitempty"`
+}
+
+func getWallet(t *testing.T, conn *websocket.Conn, id string) int {
+	err := conn.WriteJSON(&WalletMessage{Kind: "WALLET", ClientId: id})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	wrMsg := &client.WalletResultMessage{}
+	readUntil(t, conn, "WALLET", wrMsg)
+	return wrMsg.Wallet
+}
+
+func TestDuelAccept(t *testing.T) {
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	err := p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: 25})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	chMsg := &client.ChallengeResultMessage{}
+	readUntil(t, p1, "CHALLENGE", chMsg)
+	if chMsg.DuelId == "" {
+		t.Fatalf("Expected DuelId but got empty string")
+	}
+
+	cdMsg := &client.ChallengedMessage{}
+	readUntil(t, p2, "CHALLENGED", cdMsg)
+	if cdMsg.DuelId != chMsg.DuelId || cdMsg.Bet != 25 {
+		t.Errorf("Expected challenge %s for 25 but got %s for %d", chMsg.DuelId, cdMsg.DuelId, cdMsg.Bet)
+	}
+
+	if w := getWallet(t, p1, a1.ClientId); w != 75 {
+		t.Errorf("Expected stake in escrow (75) but got %d", w)
+	}
+
+	err = p2.WriteJSON(&DuelMessage{Kind: "ACCEPT", ClientId: a2.ClientId, DuelId: cdMsg.DuelId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	r1 := &client.DuelResultMessage{}
+	readUntil(t, p1, "DUELRESULT", r1)
+	r2 := &client.DuelResultMessage{}
+	readUntil(t, p2, "DUELRESULT", r2)
+
+	if *r1 != *r2 {
+		t.Errorf("Expected the same result for both players but got %+v and %+v", r1, r2)
+	}
+
+	if r1.ChallengerRoll == r1.OpponentRoll {
+		t.Errorf("Expected a winner but both rolled %d", r1.ChallengerRoll)
+	}
+
+	if r1.Pot != 50 || r1.Payout != 50 {
+		t.Errorf("Expected pot and payout of 50 but got %d and %d", r1.Pot, r1.Payout)
+	}
+
+	total := getWallet(t, p1, a1.ClientId) + getWallet(t, p2, a2.ClientId)
+	if total != 200 {
+		t.Errorf("Expected wallets to add up to 200 but got %d", total)
+	}
+}
+
+func TestDuelDeclineRefunds(t *testing.T) {
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	err := p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: 40})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cdMsg := &client.ChallengedMessage{}
+	readUntil(t, p2, "CHALLENGED", cdMsg)
+
+	err = p2.WriteJSON(&DuelMessage{Kind: "DECLINE", ClientId: a2.ClientId, DuelId: cdMsg.DuelId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	dcMsg := &client.DuelCancelledMessage{}
+	readUntil(t, p1, "DUELCANCELLED", dcMsg)
+	if dcMsg.Reason != "DECLINED" || dcMsg.Refund != 40 {
+		t.Errorf("Expected DECLINED with a 40 refund but got %s with %d", dcMsg.Reason, dcMsg.Refund)
+	}
+
+	if w := getWallet(t, p1, a1.ClientId); w != 100 {
+		t.Errorf("Expected refunded wallet (100) but got %d", w)
+	}
+}
+
+func TestDuelExpires(t *testing.T) {
+	client.DuelTimeout = 100 * time.Millisecond
+
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	err := p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	dcMsg := &client.DuelCancelledMessage{}
+	readUntil(t, p1, "DUELCANCELLED", dcMsg)
+	if dcMsg.Reason != "EXPIRED" {
+		t.Errorf("Expected EXPIRED but got %s", dcMsg.Reason)
+	}
+
+	if w := getWallet(t, p1, a1.ClientId); w != 100 {
+		t.Errorf("Expected refunded wallet (100) but got %d", w)
+	}
+}
+
+func TestChallengeSelf(t *testing.T) {
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+
+	err := p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a1.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, p1, "ERROR", cErr)
+	if cErr.Code != client.INVALID_OPPONENT {
+		t.Errorf("Expected INVALID_OPPONENT as Code but got %d", cErr.Code)
+	}
+}
+
+func TestChallengeOfflineOpponent(t *testing.T) {
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	p2.Close()
+
+	// still in the store until it expires, but with no device to answer
+	deadline := time.Now().Add(5 * time.Second)
+	for client.FindClient(a2.ClientId).Online() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the opponent to go offline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, p1, "ERROR", cErr)
+	if cErr.Code != client.INVALID_OPPONENT {
+		t.Errorf("Expected INVALID_OPPONENT as Code but got %d", cErr.Code)
+	}
+	if w := getWallet(t, p1, a1.ClientId); w != 100 {
+		t.Errorf("Expected the stake left in the wallet (100) but got %d", w)
+	}
+}
+
+func TestChallengeBetLimits(t *testing.T) {
+	r := rules.Default()
+	r.Version = "duel-bounds"
+	r.MinBet, r.MaxBet = 5, 20
+	err := rules.Set(r)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer rules.Set(rules.Default())
+
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	for _, bet := range []int{4, 21} {
+		err := p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: bet})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+
+		cErr := &client.ErrorResultMessage{}
+		readUntil(t, p1, "ERROR", cErr)
+		if cErr.Code != client.INVALID_BET {
+			t.Errorf("Expected INVALID_BET for a stake of %d but got %d", bet, cErr.Code)
+		}
+	}
+	if w := getWallet(t, p1, a1.ClientId); w != 100 {
+		t.Errorf("Expected nothing taken from the wallet (100) but got %d", w)
+	}
+}
+
+type TournamentMessage struct {
+	Kind       string `json:"kind"`
+	ClientId   string `json:"clientId"`
+	Tournament string `json:"tournament,omitempty"`
+	Bet        int    `json:"bet,omitempty"`
+	Choice     string `json:"choice,omitempty"`
+}
+
+func TestTournament(t *testing.T) {
+	tour, err := client.ScheduleTournament(client.TournamentConfig{
+		BuyIn:        10,
+		Chips:        100,
+		Registration: 300 * time.Millisecond,
+		MaxRolls:     1,
+		MinPlayers:   2,
+		Prizes:       []int{70, 30},
+	})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	err = p1.WriteJSON(&TournamentMessage{Kind: "TOURNAMENTS", ClientId: a1.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	lMsg := &client.TournamentsResultMessage{}
+	readUntil(t, p1, "TOURNAMENTS", lMsg)
+	found := false
+	for _, info := range lMsg.Tournaments {
+		found = found || info.Id == tour.Id
+	}
+	if !found {
+		t.Errorf("Expected tournament %s to be listed", tour.Id)
+	}
+
+	for _, p := range []struct {
+		conn *websocket.Conn
+		id   string
+	}{{p1, a1.ClientId}, {p2, a2.ClientId}} {
+		err := p.conn.WriteJSON(&TournamentMessage{Kind: "TREGISTER", ClientId: p.id, Tournament: tour.Id})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+
+		rMsg := &client.TournamentRegisterResultMessage{}
+		readUntil(t, p.conn, "TREGISTER", rMsg)
+		if rMsg.Wallet != 90 {
+			t.Errorf("Expected buy-in taken from wallet (90) but got %d", rMsg.Wallet)
+		}
+	}
+
+	for _, p := range []struct {
+		conn *websocket.Conn
+		id   string
+	}{{p1, a1.ClientId}, {p2, a2.ClientId}} {
+		sMsg := &client.TournamentStartMessage{}
+		readUntil(t, p.conn, "TOURNAMENTSTART", sMsg)
+
+		err := p.conn.WriteJSON(&TournamentMessage{Kind: "TPLAY", ClientId: p.id, Tournament: tour.Id, Bet: 50, Choice: "ODD"})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+
+		rMsg := &client.TournamentPlayResultMessage{}
+		readUntil(t, p.conn, "TROLL", rMsg)
+		if rMsg.Chips != 50 && rMsg.Chips != 150 {
+			t.Errorf("Expected 50 or 150 chips but got %d", rMsg.Chips)
+		}
+
+		if rMsg.RollsLeft != 0 {
+			t.Errorf("Expected 0 rolls left but got %d", rMsg.RollsLeft)
+		}
+	}
+
+	// both out of rolls so it ends straight away
+	eMsg := &client.StandingsMessage{}
+	readUntil(t, p1, "TOURNAMENTEND", eMsg)
+	if len(eMsg.Standings) != 2 {
+		t.Fatalf("Expected 2 standings but got %d", len(eMsg.Standings))
+	}
+
+	if eMsg.Standings[0].Prize != 14 || eMsg.Standings[1].Prize != 6 {
+		t.Errorf("Expected prizes 14 and 6 but got %d and %d", eMsg.Standings[0].Prize, eMsg.Standings[1].Prize)
+	}
+
+	total := getWallet(t, p1, a1.ClientId) + getWallet(t, p2, a2.ClientId)
+	if total != 200 {
+		t.Errorf("Expected wallets to add up to 200 but got %d", total)
+	}
+}
+
+func TestTournamentPrizeSplit(t *testing.T) {
+	tour, err := client.ScheduleTournament(client.TournamentConfig{
+		BuyIn:        10,
+		Chips:        100,
+		Registration: 300 * time.Millisecond,
+		MaxRolls:     1,
+		MinPlayers:   2,
+		Prizes:       []int{50, 30, 20},
+	})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	players := make([]struct {
+		conn *websocket.Conn
+		id   string
+	}, 2)
+	for i := range players {
+		conn, a := dialAndAuth(t)
+		defer conn.Close()
+		players[i].conn, players[i].id = conn, a.ClientId
+
+		err := conn.WriteJSON(&TournamentMessage{Kind: "TREGISTER", ClientId: a.ClientId, Tournament: tour.Id})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		readUntil(t, conn, "TREGISTER", &client.TournamentRegisterResultMessage{})
+	}
+	for _, p := range players {
+		readUntil(t, p.conn, "TOURNAMENTSTART", &client.TournamentStartMessage{})
+		err := p.conn.WriteJSON(&TournamentMessage{Kind: "TPLAY", ClientId: p.id, Tournament: tour.Id, Bet: 50, Choice: "EVEN"})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		readUntil(t, p.conn, "TROLL", &client.TournamentPlayResultMessage{})
+	}
+
+	// nobody took 3rd, its 20% goes to 1st and 2nd as 50 to 30
+	eMsg := &client.StandingsMessage{}
+	readUntil(t, players[0].conn, "TOURNAMENTEND", eMsg)
+	if len(eMsg.Standings) != 2 {
+		t.Fatalf("Expected 2 standings but got %d", len(eMsg.Standings))
+	}
+	if eMsg.Standings[0].Prize != 13 || eMsg.Standings[1].Prize != 7 {
+		t.Errorf("Expected prizes 13 and 7 but got %d and %d", eMsg.Standings[0].Prize, eMsg.Standings[1].Prize)
+	}
+}
+
+func TestTournamentConfigValidated(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *client.TournamentConfig)
+	}{
+		{"no prizes", func(cfg *client.TournamentConfig) { cfg.Prizes = nil }},
+		{"prizes under 100", func(cfg *client.TournamentConfig) { cfg.Prizes = []int{50, 30} }},
+		{"prizes over 100", func(cfg *client.TournamentConfig) { cfg.Prizes = []int{70, 40} }},
+		{"negative prize", func(cfg *client.TournamentConfig) { cfg.Prizes = []int{110, -10} }},
+		{"no chips", func(cfg *client.TournamentConfig) { cfg.Chips = 0 }},
+		{"negative chips", func(cfg *client.TournamentConfig) { cfg.Chips = -100 }},
+		{"negative buy-in", func(cfg *client.TournamentConfig) { cfg.BuyIn = -1 }},
+		{"no registration", func(cfg *client.TournamentConfig) { cfg.Registration = 0 }},
+		{"negative duration", func(cfg *client.TournamentConfig) { cfg.Duration = -time.Minute }},
+		{"negative rolls", func(cfg *client.TournamentConfig) { cfg.MaxRolls = -1 }},
+		{"never ends", func(cfg *client.TournamentConfig) { cfg.Duration, cfg.MaxRolls = 0, 0 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := client.DefaultTournament
+			cfg.Prizes = append([]int(nil), cfg.Prizes...)
+			tt.change(&cfg)
+			if cfg.Validate() == nil {
+				t.Errorf("Expected %+v to be refused", cfg)
+			}
+			if _, err := client.ScheduleTournament(cfg); err == nil {
+				t.Errorf("Expected ScheduleTournament to refuse %+v", cfg)
+			}
+		})
+	}
+
+	// a free tournament with only one of the limits is fine
+	cfg := client.DefaultTournament
+	cfg.BuyIn, cfg.Duration = 0, 0
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected %+v to be valid but got %v", cfg, err)
+	}
+}
+
+func TestTournamentRules(t *testing.T) {
+	r := rules.Default()
+	r.Version = "tournament-low"
+	r.BetTypes[rules.ODD].Enabled = false
+	r.BetTypes[rules.LOW] = &rules.Bet{Enabled: true, Pays: 2}
+	err := rules.Set(r)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer rules.Set(rules.Default())
+
+	tour, err := client.ScheduleTournament(client.TournamentConfig{
+		BuyIn:        10,
+		Chips:        100,
+		Registration: 300 * time.Millisecond,
+		MaxRolls:     1,
+		MinPlayers:   2,
+		Prizes:       []int{70, 30},
+	})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	players := make([]struct {
+		conn *websocket.Conn
+		id   string
+	}, 2)
+	for i := range players {
+		conn, a := dialAndAuth(t)
+		defer conn.Close()
+		players[i].conn, players[i].id = conn, a.ClientId
+
+		err := conn.WriteJSON(&TournamentMessage{Kind: "TREGISTER", ClientId: a.ClientId, Tournament: tour.Id})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		readUntil(t, conn, "TREGISTER", &client.TournamentRegisterResultMessage{})
+	}
+	p := players[0]
+	readUntil(t, p.conn, "TOURNAMENTSTART", &client.TournamentStartMessage{})
+
+	err = p.conn.WriteJSON(&TournamentMessage{Kind: "TPLAY", ClientId: p.id, Tournament: tour.Id, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, p.conn, "ERROR", cErr)
+	if cErr.Code != client.INVALID_CHOICE {
+		t.Errorf("Expected INVALID_CHOICE for a disabled bet type but got %d", cErr.Code)
+	}
+
+	err = p.conn.WriteJSON(&TournamentMessage{Kind: "TPLAY", ClientId: p.id, Tournament: tour.Id, Bet: 10, Choice: "LOW"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	rMsg := &client.TournamentPlayResultMessage{}
+	readUntil(t, p.conn, "TROLL", rMsg)
+	want := 90
+	if rMsg.Result == "WIN" {
+		want = 120
+	}
+	if rMsg.Chips != want {
+		t.Errorf("Expected %d chips after a %s paying 2 to 1 but got %d", want, rMsg.Result, rMsg.Chips)
+	}
+}
+
+func TestJackpotContribute(t *testing.T) {
+	j := &client.Jackpot{}
+
+	// 1% of 150 is 1.5 points, the half carries over
+	if points := j.Contribute(150); points != 1 {
+		t.Errorf("Expected 1 point to go in but got %d", points)
+	}
+	if j.Value() != 1 {
+		t.Errorf("Expected pool of 1 but got %d", j.Value())
+	}
+
+	j.Contribute(50)
+	if j.Value() != 2 {
+		t.Errorf("Expected pool of 2 but got %d", j.Value())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j.Contribute(100)
+		}()
+	}
+	wg.Wait()
+
+	if j.Value() != 102 {
+		t.Errorf("Expected pool of 102 but got %d", j.Value())
+	}
+
+	won := j.Win()
+	if won != 102 {
+		t.Errorf("Expected to win 102 but got %d", won)
+	}
+
+	if j.Value() != client.JackpotSeed {
+		t.Errorf("Expected pool back at the seed (%d) but got %d", client.JackpotSeed, j.Value())
+	}
+}
+
+func TestJackpotFromStake(t *testing.T) {
+	conn, authRM := dialAndAuth(t)
+	defer conn.Close()
+
+	startSession(t, conn, authRM.ClientId)
+	pool := client.St.Jackpot.Value()
+
+	// 1% of 100 is always one whole point, whatever fraction was left over
+	profit, contributed, won := 0, 0, 0
+	for i := 0; i < 5; i++ {
+		res := play(t, conn, authRM.ClientId, 100, "ODD")
+		if res.Kind != "ROLL" {
+			t.Fatalf("Expected ROLL but got %+v", res)
+		}
+		if res.Contribution != 1 {
+			t.Errorf("Expected a contribution of 1 but got %d", res.Contribution)
+		}
+		if res.Result == "WIN" {
+			profit += 100
+		} else {
+			profit -= 100
+		}
+		contributed += res.Contribution
+		won += res.Jackpot
+	}
+
+	end := &client.EndPlayResultMessage{}
+	err := conn.WriteJSON(&EndPlayMessage{Kind: "ENDPLAY", ClientId: authRM.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ENDPLAY", end)
+
+	// what the wallet lost to the pool is what the pool gained
+	if end.Profit != profit-contributed {
+		t.Errorf("Expected profit %d but got %d", profit-contributed, end.Profit)
+	}
+	if won == 0 && client.St.Jackpot.Value() != pool+contributed {
+		t.Errorf("Expected pool %d but got %d", pool+contributed, client.St.Jackpot.Value())
+	}
+	if got := getWallet(t, conn, authRM.ClientId); got != 100+profit-contributed+won {
+		t.Errorf("Expected wallet %d but got %d", 100+profit-contributed+won, got)
+	}
+}
+
+type LimitsMessage struct {
+	Kind         string         `json:"kind"`
+	ClientId     string         `json:"clientId"`
+	Limits       *client.Limits `json:"limits,omitempty"`
+	CoolOffHours int            `json:"coolOffHours,omitempty"`
+	ExcludeDays  int            `json:"excludeDays,omitempty"`
+}
+
+func TestWagerLimit(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	err := conn.WriteJSON(&LimitsMessage{Kind: "LIMITS", ClientId: a.ClientId, Limits: &client.Limits{DailyWager: 15}})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	lMsg := &client.LimitsResultMessage{}
+	readUntil(t, conn, "LIMITS", lMsg)
+	if lMsg.Limits.DailyWager != 15 {
+		t.Errorf("Expected tightened limit to apply straight away but got %d", lMsg.Limits.DailyWager)
+	}
+
+	err = conn.WriteJSON(&StartSessionMessage{Kind: "STARTPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "STARTPLAY", &client.StartSessionResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ROLL", &client.PlayResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.WAGER_LIMIT {
+		t.Errorf("Expected WAGER_LIMIT as Code but got %d", cErr.Code)
+	}
+
+	// loosening only applies after the delay
+	err = conn.WriteJSON(&LimitsMessage{Kind: "LIMITS", ClientId: a.ClientId, Limits: &client.Limits{DailyWager: 0}})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	lMsg = &client.LimitsResultMessage{}
+	readUntil(t, conn, "LIMITS", lMsg)
+	if lMsg.Limits.DailyWager != 15 {
+		t.Errorf("Expected limit to stay at 15 but got %d", lMsg.Limits.DailyWager)
+	}
+
+	if lMsg.Pending == nil || lMsg.Pending.DailyWager != 0 {
+		t.Errorf("Expected pending removal of the limit but got %+v", lMsg.Pending)
+	}
+
+	if !lMsg.PendingAt.After(time.Now()) {
+		t.Errorf("Expected pending limits in the future but got %s", lMsg.PendingAt)
+	}
+}
+
+func TestCoolOff(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	err := conn.WriteJSON(&LimitsMessage{Kind: "LIMITS", ClientId: a.ClientId, CoolOffHours: 1})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	lMsg := &client.LimitsResultMessage{}
+	readUntil(t, conn, "LIMITS", lMsg)
+	if !lMsg.CoolOffUntil.After(time.Now()) {
+		t.Errorf("Expected cool-off in the future but got %s", lMsg.CoolOffUntil)
+	}
+
+	err = conn.WriteJSON(&StartSessionMessage{Kind: "STARTPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.COOLING_OFF {
+		t.Errorf("Expected COOLING_OFF as Code but got %d", cErr.Code)
+	}
+}
+
+func TestExcludedStakes(t *testing.T) {
+	tour, err := client.ScheduleTournament(client.TournamentConfig{
+		BuyIn:        10,
+		Chips:        100,
+		Registration: time.Minute,
+		MaxRolls:     1,
+		MinPlayers:   2,
+		Prizes:       []int{100},
+	})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+	other, o := dialAndAuth(t)
+	defer other.Close()
+
+	err = conn.WriteJSON(&LimitsMessage{Kind: "LIMITS", ClientId: a.ClientId, ExcludeDays: 1})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "LIMITS", &client.LimitsResultMessage{})
+
+	err = conn.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a.ClientId, Opponent: o.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.SELF_EXCLUDED {
+		t.Errorf("Expected SELF_EXCLUDED on CHALLENGE but got %d", cErr.Code)
+	}
+
+	err = other.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: o.ClientId, Opponent: a.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cdMsg := &client.ChallengedMessage{}
+	readUntil(t, conn, "CHALLENGED", cdMsg)
+	err = conn.WriteJSON(&DuelMessage{Kind: "ACCEPT", ClientId: a.ClientId, DuelId: cdMsg.DuelId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr = &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.SELF_EXCLUDED {
+		t.Errorf("Expected SELF_EXCLUDED on ACCEPT but got %d", cErr.Code)
+	}
+
+	err = conn.WriteJSON(&TournamentMessage{Kind: "TREGISTER", ClientId: a.ClientId, Tournament: tour.Id})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr = &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.SELF_EXCLUDED {
+		t.Errorf("Expected SELF_EXCLUDED on TREGISTER but got %d", cErr.Code)
+	}
+
+	if w := getWallet(t, conn, a.ClientId); w != 100 {
+		t.Errorf("Expected nothing taken from the wallet (100) but got %d", w)
+	}
+}
+
+func TestDuelStakeCountsTowardLimits(t *testing.T) {
+	p1, a1 := dialAndAuth(t)
+	defer p1.Close()
+	p2, a2 := dialAndAuth(t)
+	defer p2.Close()
+
+	err := p1.WriteJSON(&LimitsMessage{Kind: "LIMITS", ClientId: a1.ClientId, Limits: &client.Limits{DailyWager: 15}})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, p1, "LIMITS", &client.LimitsResultMessage{})
+
+	err = p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, p1, "CHALLENGE", &client.ChallengeResultMessage{})
+
+	// the escrowed stake already counts
+	err = p1.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a1.ClientId, Opponent: a2.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, p1, "ERROR", cErr)
+	if cErr.Code != client.WAGER_LIMIT {
+		t.Errorf("Expected WAGER_LIMIT but got %d", cErr.Code)
+	}
+}
+
+func TestRealityCheck(t *testing.T) {
+	client.RealityCheckInterval = 200 * time.Millisecond
+	defer func() {
+		client.RealityCheckInterval = 30 * time.Minute
+	}()
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	err := conn.WriteJSON(&StartSessionMessage{Kind: "STARTPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "STARTPLAY", &client.StartSessionResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "EVEN"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	roll := &client.PlayResultMessage{}
+	readUntil(t, conn, "ROLL", roll)
+
+	rcMsg := &client.RealityCheckMessage{}
+	readUntil(t, conn, "REALITYCHECK", rcMsg)
+	if rcMsg.Plays != 1 {
+		t.Errorf("Expected 1 play but got %d", rcMsg.Plays)
+	}
+
+	if p := rcMsg.Profit + roll.Contribution; p != 10 && p != -10 {
+		t.Errorf("Expected profit of 10 or -10 before the jackpot but got %d", p)
+	}
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "EVEN"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.REALITY_CHECK_PENDING {
+		t.Errorf("Expected REALITY_CHECK_PENDING as Code but got %d", cErr.Code)
+	}
+
+	err = conn.WriteJSON(&WalletMessage{Kind: "REALITYACK", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "REALITYACK", &client.RealityAckResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "EVEN"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ROLL", &client.PlayResultMessage{})
+}
+
+func TestRateLimited(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	// WALLET allows a burst of 10 per connection
+	for i := 0; i < 15; i++ {
+		err := conn.WriteJSON(&WalletMessage{Kind: "WALLET", ClientId: a.ClientId})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.RATE_LIMITED {
+		t.Errorf("Expected RATE_LIMITED as Code but got %d", cErr.Code)
+	}
+
+	if cErr.RetryAfter <= 0 {
+		t.Errorf("Expected a retry-after hint but got %d", cErr.RetryAfter)
+	}
+}
+
+func TestRateLimitIgnoresClaimedClientId(t *testing.T) {
+	victim, a := dialAndAuth(t)
+	defer victim.Close()
+
+	// more than the client's burst of 60, sent from connections that never
+	// logged in as it
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	for i := 0; i < 3; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		defer conn.Close()
+
+		for j := 0; j < 30; j++ {
+			err := conn.WriteJSON(&TournamentMessage{Kind: "TOURNAMENTS", ClientId: a.ClientId})
+			if err != nil {
+				t.Fatalf("Error: %+v", err)
+			}
+			readUntil(t, conn, "TOURNAMENTS", &client.TournamentsResultMessage{})
+		}
+	}
+
+	err := victim.WriteJSON(&WalletMessage{Kind: "WALLET", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	res := playReply{}
+	err = victim.ReadJSON(&res)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if res.Kind != "WALLET" {
+		t.Errorf("Expected WALLET but got %+v", res)
+	}
+}
+
+func TestOriginNotAllowed(t *testing.T) {
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	header := http.Header{"Origin": []string{"https://evil.example.com"}}
+
+	_, resp, err := websocket.DefaultDialer.Dial(u, header)
+	if err == nil {
+		t.Fatalf("Expected upgrade to be rejected")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected %d but got %+v", http.StatusForbidden, resp)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	header := http.Header{"Origin": []string{"http://localhost:3000"}}
+
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	conn.Close()
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	// ws from TestMain is already connected from the same address
+	handlers.Admit.MaxConnectionsPerIP = 1
+	defer func() {
+		handlers.Admit.MaxConnectionsPerIP = 20
+	}()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		t.Fatalf("Expected upgrade to be rejected")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected %d but got %+v", http.StatusTooManyRequests, resp)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	big := &ProfileMessage{
+		Kind:        "PROFILE",
+		ClientId:    a.ClientId,
+		DisplayName: strings.Repeat("x", 8192),
+	}
+
+	err := conn.WriteJSON(big)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig, websocket.CloseNormalClosure) {
+		t.Errorf("Expected connection to be closed but got %+v", err)
+	}
+}
+
+// Logs another connection in as an existing client
+func dialDevice(t *testing.T, clientId string, kick bool) *websocket.Conn {
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	err = conn.WriteJSON(&AuthMessage{Kind: "AUTH", ClientId: clientId, Kick: kick})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	return conn
+}
+
+func TestMultiDevice(t *testing.T) {
+	phone, authRM := dialAndAuth(t)
+	defer phone.Close()
+
+	laptop := dialDevice(t, authRM.ClientId, false)
+
+	laptopAuth := &client.AuthResultMessage{}
+	readUntil(t, laptop, "AUTH", laptopAuth)
+	if laptopAuth.ClientId != authRM.ClientId {
+		t.Fatalf("Expected clientId %s but got %s", authRM.ClientId, laptopAuth.ClientId)
+	}
+
+	login := &client.DeviceLoginMessage{}
+	readUntil(t, phone, "DEVICELOGIN", login)
+	if login.Devices != 2 {
+		t.Errorf("Expected 2 devices but got %d", login.Devices)
+	}
+
+	// replies go to every device
+	err := laptop.WriteJSON(&WalletMessage{Kind: "WALLET", ClientId: authRM.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	wallet := &client.WalletResultMessage{}
+	readUntil(t, laptop, "WALLET", wallet)
+	readUntil(t, phone, "WALLET", wallet)
+
+	// closing one device leaves the client logged in on the other
+	laptop.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if got := getWallet(t, phone, authRM.ClientId); got != 100 {
+		t.Errorf("Expected wallet 100 but got %d", got)
+	}
+}
+
+func TestTooManyDevices(t *testing.T) {
+	client.MaxDevices = 2
+	defer func() { client.MaxDevices = 5 }()
+
+	first, authRM := dialAndAuth(t)
+	defer first.Close()
+
+	second := dialDevice(t, authRM.ClientId, false)
+	defer second.Close()
+	readUntil(t, second, "AUTH", &client.AuthResultMessage{})
+
+	third := dialDevice(t, authRM.ClientId, false)
+	defer third.Close()
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, third, "ERROR", cErr)
+	if cErr.Code != client.TOO_MANY_DEVICES {
+		t.Fatalf("Expected TOO_MANY_DEVICES but got %d", cErr.Code)
+	}
+
+	// kick makes room by closing the oldest device
+	fourth := dialDevice(t, authRM.ClientId, true)
+	defer fourth.Close()
+	readUntil(t, fourth, "AUTH", &client.AuthResultMessage{})
+	readUntil(t, first, "KICKED", &client.KickedMessage{})
+
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := first.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("Expected normal closure but got %+v", err)
+			}
+			break
+		}
+	}
+}
+
+// run with -race, both devices' reader goroutines use the same session
+func TestPlayFromTwoDevices(t *testing.T) {
+	phone, authRM := dialAndAuth(t)
+	defer phone.Close()
+
+	laptop := dialDevice(t, authRM.ClientId, false)
+	defer laptop.Close()
+	readUntil(t, laptop, "AUTH", &client.AuthResultMessage{})
+
+	startSession(t, phone, authRM.ClientId)
+
+	const plays = 10
+	var wg sync.WaitGroup
+	for _, conn := range []*websocket.Conn{phone, laptop} {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for i := 0; i < plays; i++ {
+				err := conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: authRM.ClientId, Bet: 1, Choice: "ODD"})
+				if err != nil {
+					t.Errorf("Error: %+v", err)
+					return
+				}
+				// the profile changes mid session too
+				if conn == laptop && i == plays/2 {
+					err = conn.WriteJSON(&ProfileMessage{Kind: "PROFILE", ClientId: authRM.ClientId, DisplayName: "dev-" + uuid.NewString()[:8]})
+					if err != nil {
+						t.Errorf("Error: %+v", err)
+						return
+					}
+				}
+			}
+		}(conn)
+	}
+
+	// every ROLL goes to both devices, the phone sees all of them
+	profit, won := 0, 0
+	for i := 0; i < 2*plays; i++ {
+		res := playReply{}
+		readUntil(t, phone, "ROLL", &res)
+		if res.Result == "WIN" {
+			profit++
+		} else {
+			profit--
+		}
+		profit -= res.Contribution
+		won += res.Jackpot
+	}
+	wg.Wait()
+
+	err := phone.WriteJSON(&EndPlayMessage{Kind: "ENDPLAY", ClientId: authRM.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	end := &client.EndPlayResultMessage{}
+	readUntil(t, phone, "ENDPLAY", end)
+	if end.Profit != profit {
+		t.Errorf("Expected profit %d but got %d", profit, end.Profit)
+	}
+	if end.Wallet != 100+profit+won {
+		t.Errorf("Expected wallet %d but got %d", 100+profit+won, end.Wallet)
+	}
+}
+
+func TestRegisterGuest(t *testing.T) {
+	client.BcryptCost = bcrypt.MinCost
+	username := "user-" + uuid.NewString()[:8]
+
+	guest, authRM := dialAndAuth(t)
+	defer guest.Close()
+
+	err := guest.WriteJSON(&AccountMessage{Kind: "REGISTER", ClientId: authRM.ClientId, Username: username, Password: "hunter22"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	reg := &client.AccountResultMessage{}
+	readUntil(t, guest, "REGISTER", reg)
+	if reg.ClientId != authRM.ClientId {
+		t.Fatalf("Expected guest clientId %s but got %s", authRM.ClientId, reg.ClientId)
+	}
+
+	// logging in elsewhere gets the same client, wallet and all
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	other, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer other.Close()
+
+	err = other.WriteJSON(&AccountMessage{Kind: "LOGIN", Username: strings.ToUpper(username), Password: "hunter22"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	login := &client.AccountResultMessage{}
+	readUntil(t, other, "LOGIN", login)
+	if login.ClientId != authRM.ClientId {
+		t.Fatalf("Expected clientId %s but got %s", authRM.ClientId, login.ClientId)
+	}
+	readUntil(t, guest, "DEVICELOGIN", &client.DeviceLoginMessage{})
+
+	err = other.WriteJSON(&AccountMessage{Kind: "REGISTER", Username: username, Password: "hunter22"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, other, "ERROR", cErr)
+	if cErr.Code != client.ACCOUNT_EXISTS {
+		t.Errorf("Expected ACCOUNT_EXISTS but got %d", cErr.Code)
+	}
+}
+
+func postCredentials(t *testing.T, h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestHTTPLoginLockout(t *testing.T) {
+	client.BcryptCost = bcrypt.MinCost
+	client.MaxLoginFailures = 3
+	defer func() { client.MaxLoginFailures = 5 }()
+
+	username := "user-" + uuid.NewString()[:8]
+	creds := fmt.Sprintf(`{"username": %q, "password": "hunter22"}`, username)
+	wrong := fmt.Sprintf(`{"username": %q, "password": "hunter23"}`, username)
+
+	rec := postCredentials(t, handlers.Register, creds)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 but got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = postCredentials(t, handlers.Register, creds)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 but got %d", rec.Code)
+	}
+
+	rec = postCredentials(t, handlers.Login, creds)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d: %s", rec.Code, rec.Body)
+	}
+
+	for i := 0; i < client.MaxLoginFailures; i++ {
+		rec = postCredentials(t, handlers.Login, wrong)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 but got %d", rec.Code)
+		}
+	}
+
+	// right password doesn't help while locked
+	rec = postCredentials(t, handlers.Login, creds)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 but got %d", rec.Code)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	err := json.Unmarshal(rec.Body.Bytes(), cErr)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if cErr.Code != client.ACCOUNT_LOCKED {
+		t.Errorf("Expected ACCOUNT_LOCKED but got %d", cErr.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header")
+	}
+}
+
+func TestAccountAuthNeedsToken(t *testing.T) {
+	client.BcryptCost = bcrypt.MinCost
+	username := "user-" + uuid.NewString()[:8]
+
+	rec := postCredentials(t, handlers.Register, fmt.Sprintf(`{"username": %q, "password": "hunter22"}`, username))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 but got %d: %s", rec.Code, rec.Body)
+	}
+	reg := &client.AccountResultMessage{}
+	err := json.Unmarshal(rec.Body.Bytes(), reg)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if reg.Token == "" {
+		t.Fatalf("Expected a login token but got %s", rec.Body)
+	}
+
+	auth := func(token string) *websocket.Conn {
+		u := "ws" + strings.TrimPrefix(s.URL, "http")
+		conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		err = conn.WriteJSON(&AuthMessage{Kind: "AUTH", ClientId: reg.ClientId, Token: token})
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		return conn
+	}
+
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{"", int(client.LOGIN_REQUIRED)},
+		{"made-up", int(client.INVALID_CREDENTIALS)},
+	} {
+		conn := auth(c.token)
+		cErr := &client.ErrorResultMessage{}
+		readUntil(t, conn, "ERROR", cErr)
+		if int(cErr.Code) != c.code {
+			t.Errorf("Expected %d with token %q but got %d", c.code, c.token, cErr.Code)
+		}
+		conn.Close()
+	}
+
+	conn := auth(reg.Token)
+	defer conn.Close()
+	authRM := &client.AuthResultMessage{}
+	readUntil(t, conn, "AUTH", authRM)
+	if authRM.ClientId != reg.ClientId {
+		t.Errorf("Expected clientId %s but got %s", reg.ClientId, authRM.ClientId)
+	}
+
+	// tokens work once
+	again := auth(reg.Token)
+	defer again.Close()
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, again, "ERROR", cErr)
+	if cErr.Code != client.INVALID_CREDENTIALS {
+		t.Errorf("Expected INVALID_CREDENTIALS for a used token but got %d", cErr.Code)
+	}
+}
+
+func TestHTTPRegisterGuestRefused(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	rec := postCredentials(t, handlers.Register, fmt.Sprintf(`{"username": %q, "password": "hunter22", "clientId": %q}`, "user-"+uuid.NewString()[:8], a.ClientId))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 but got %d: %s", rec.Code, rec.Body)
+	}
+	if client.FindClient(a.ClientId).Info().Username != "" {
+		t.Errorf("Expected the guest to stay a guest")
+	}
+}
+
+// Vouches for whoever comes back with the code "good"
+type fakeProvider struct{}
+
+func (fakeProvider) Name() string { return "fake" }
+
+func (fakeProvider) Begin() (string, error) {
+	return "https://idp.example.com/authorize?state=s1", nil
+}
+
+func (fakeProvider) Finish(ctx context.Context, state, code string) (*identity.Identity, error) {
+	if state != "s1" || code != "good" {
+		return nil, identity.ErrInvalidToken
+	}
+	return &identity.Identity{Provider: "fake", Subject: "bob"}, nil
+}
+
+func TestIdentityLogin(t *testing.T) {
+	handlers.Providers["fake"] = fakeProvider{}
+	defer delete(handlers.Providers, "fake")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /auth/{provider}/login", handlers.IdentityLogin)
+	mux.HandleFunc("GET /auth/{provider}/callback", handlers.IdentityCallback)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/auth/fake/login")
+	if rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), "https://idp.example.com/") {
+		t.Fatalf("Expected redirect to the provider but got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		rec = get("/auth/fake/callback?state=s1&code=good")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 but got %d: %s", rec.Code, rec.Body)
+		}
+
+		res := &client.IdentityResultMessage{}
+		err := json.Unmarshal(rec.Body.Bytes(), res)
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		if res.Token == "" {
+			t.Errorf("Expected a login token")
+		}
+		ids = append(ids, res.ClientId)
+	}
+
+	// same subject, same client
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Expected the same clientId twice but got %v", ids)
+	}
+
+	rec = get("/auth/fake/callback?state=s1&code=bad")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 but got %d", rec.Code)
+	}
+
+	rec = get("/auth/nope/login")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 but got %d", rec.Code)
+	}
+}
+
+func TestGuestsDisabled(t *testing.T) {
+	client.AllowGuests = false
+	defer func() { client.AllowGuests = true }()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(&AuthMessage{Kind: "AUTH"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.LOGIN_REQUIRED {
+		t.Errorf("Expected LOGIN_REQUIRED but got %d", cErr.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	err := conn.WriteJSON(&StartSessionMessage{Kind: "STARTPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "STARTPLAY", &client.StartSessionResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ROLL", &client.PlayResultMessage{})
+
+	err = conn.WriteJSON(&AuthMessage{Kind: "SOMETHING_MADE_UP"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ERROR", &client.ErrorResultMessage{})
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`dicegame_connections_active`,
+		`dicegame_messages_received_total{kind="PLAY"}`,
+		`dicegame_messages_received_total{kind="other"}`,
+		`dicegame_errors_total{code="10"}`,
+		`dicegame_plays_total{choice="ODD"`,
+		`dicegame_wagered_points_total`,
+		`dicegame_rtp_ratio`,
+		`dicegame_send_duration_seconds_count`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in /metrics", want)
+		}
+	}
+
+	if strings.Contains(body, "SOMETHING_MADE_UP") {
+		t.Errorf("Unknown kinds shouldn't become labels")
+	}
+}
+
+// Waits for the server to end n spans named name, spans end after the reply
+// is written so the client can get there first
+func endedSpans(t *testing.T, exp *tracetest.InMemoryExporter, name string, n int) []tracetest.SpanStub {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		var found []tracetest.SpanStub
+		for _, s := range exp.GetSpans() {
+			if s.Name == name {
+				found = append(found, s)
+			}
+		}
+		if len(found) >= n || time.Now().After(deadline) {
+			if len(found) < n {
+				t.Fatalf("Expected %d %q spans but got %d", n, name, len(found))
+			}
+			return found
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func spanAttr(s tracetest.SpanStub, key string) (attribute.Value, bool) {
+	for _, kv := range s.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	err := conn.WriteJSON(&StartSessionMessage{Kind: "STARTPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "STARTPLAY", &client.StartSessionResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ROLL", &client.PlayResultMessage{})
+
+	err = conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 0, Choice: "ODD"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "ERROR", &client.ErrorResultMessage{})
+
+	messages := endedSpans(t, exp, "message PLAY", 2)
+	plays := endedSpans(t, exp, "Client.Play", 2)
+	ok, bad := messages[0], messages[1]
+
+	if v, _ := spanAttr(ok, "client.id"); v.AsString() != logging.Pseudonym(a.ClientId) {
+		t.Errorf("Expected client.id %s but got %q", logging.Pseudonym(a.ClientId), v.AsString())
+	}
+	if v, _ := spanAttr(ok, "session.playing"); !v.AsBool() {
+		t.Errorf("Expected session.playing to be true")
+	}
+	if _, found := spanAttr(ok, "error.code"); found {
+		t.Errorf("Expected no error.code on a good PLAY")
+	}
+	if v, _ := spanAttr(bad, "error.code"); v.AsInt64() != int64(client.INVALID_BET) {
+		t.Errorf("Expected error.code %d but got %d", client.INVALID_BET, v.AsInt64())
+	}
+	if bad.Status.Code != codes.Error {
+		t.Errorf("Expected the bad PLAY span to be an error")
+	}
+
+	// Handler -> HandleClientID, Handler -> Client.Play -> SendMessage and audit
+	traceId := ok.SpanContext.TraceID()
+	if plays[0].Parent.SpanID() != ok.SpanContext.SpanID() {
+		t.Errorf("Expected Client.Play under the message span")
+	}
+	for _, name := range []string{"HandleClientID", "Client.SendMessage", "audit.Write"} {
+		found := false
+		for _, s := range endedSpans(t, exp, name, 1) {
+			if s.SpanContext.TraceID() != traceId {
+				continue
+			}
+			found = true
+
+			want := plays[0].SpanContext.SpanID()
+			if name == "HandleClientID" {
+				want = ok.SpanContext.SpanID()
+			}
+			if s.Parent.SpanID() != want {
+				t.Errorf("Expected %s to have the right parent", name)
+			}
+		}
+		if !found {
+			t.Errorf("Expected a %s span in the PLAY trace", name)
+		}
+	}
+
+	if messages[0].SpanContext.TraceID() == messages[1].SpanContext.TraceID() {
+		t.Errorf("Expected one trace per message")
+	}
+
+	// the other handlers send and audit under their message span too
+	start := endedSpans(t, exp, "message STARTPLAY", 1)[0]
+	for _, name := range []string{"Client.SendMessage", "audit.Write"} {
+		found := false
+		for _, s := range endedSpans(t, exp, name, 1) {
+			if s.Parent.SpanID() == start.SpanContext.SpanID() {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a %s span under the STARTPLAY message", name)
+		}
+	}
+
+	// nothing is traced on its own outside a message
+	for _, s := range exp.GetSpans() {
+		if (s.Name == "Client.SendMessage" || s.Name == "audit.Write") && !s.Parent.IsValid() {
+			t.Errorf("Expected %s to have a parent", s.Name)
+		}
+	}
+
+	// the id is only ever exported as its pseudonym
+	for _, s := range exp.GetSpans() {
+		for _, kv := range s.Attributes {
+			if strings.Contains(kv.Value.Emit(), a.ClientId) {
+				t.Errorf("Expected no raw clientId in %s but got %s=%s", s.Name, kv.Key, kv.Value.Emit())
+			}
+		}
+	}
+}
+
+// bytes.Buffer for a logger written to from the server's goroutines
+type logBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestConnectionLogger(t *testing.T) {
+	buf := &logBuffer{}
+	l, err := logging.New(buf, logging.Config{Level: "debug", Format: "json"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(l)
+	defer slog.SetDefault(prev)
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+	getWallet(t, conn, a.ClientId)
+
+	found := false
+	for _, l := range strings.Split(buf.String(), "\n") {
+		line := map[string]interface{}{}
+		json.Unmarshal([]byte(l), &line)
+		if line["msg"] != "Received message" || line["message"] != "WALLET" {
+			continue
+		}
+		found = true
+
+		if line["clientId"] != logging.Pseudonym(a.ClientId) {
+			t.Errorf("Expected clientId %s but got %v", logging.Pseudonym(a.ClientId), line["clientId"])
+		}
+		if line["conn"] == nil || line["remote"] == nil {
+			t.Errorf("Expected conn and remote on the line but got %s", l)
+		}
+	}
+	if !found {
+		t.Errorf("Expected the WALLET message to be logged but got %s", buf.String())
+	}
+
+	// replies are logged by the connection they went to, kind only
+	found = false
+	for _, l := range strings.Split(buf.String(), "\n") {
+		line := map[string]interface{}{}
+		json.Unmarshal([]byte(l), &line)
+		if line["msg"] != "Sent message" || line["message"] != "WALLET" {
+			continue
+		}
+		found = true
+
+		if line["clientId"] != logging.Pseudonym(a.ClientId) || line["conn"] == nil {
+			t.Errorf("Expected the connection's clientId and conn on the line but got %s", l)
+		}
+	}
+	if !found {
+		t.Errorf("Expected the WALLET reply to be logged but got %s", buf.String())
+	}
+
+	// a duel logs the opponent and the winner too
+	other, o := dialAndAuth(t)
+	defer other.Close()
+	err = conn.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a.ClientId, Opponent: o.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cdMsg := &client.ChallengedMessage{}
+	readUntil(t, other, "CHALLENGED", cdMsg)
+	err = other.WriteJSON(&DuelMessage{Kind: "ACCEPT", ClientId: o.ClientId, DuelId: cdMsg.DuelId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "DUELRESULT", &client.DuelResultMessage{})
+
+	for _, id := range []string{a.ClientId, o.ClientId} {
+		if strings.Contains(buf.String(), id) {
+			t.Errorf("Expected no raw clientId in the logs but got %s", buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), `"opponentId":"`+logging.Pseudonym(o.ClientId)+`"`) {
+		t.Errorf("Expected the opponent's pseudonym in the logs but got %s", buf.String())
+	}
+}
+
+func startSession(t *testing.T, conn *websocket.Conn, id string) *client.StartSessionResultMessage {
+	err := conn.WriteJSON(&StartSessionMessage{Kind: "STARTPLAY", ClientId: id})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	sMsg := &client.StartSessionResultMessage{}
+	readUntil(t, conn, "STARTPLAY", sMsg)
+	return sMsg
+}
+
+func play(t *testing.T, conn *websocket.Conn, id string, bet int, choice string) playReply {
+	err := conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: id, Bet: bet, Choice: choice})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	for {
+		res := playReply{}
+		err := conn.ReadJSON(&res)
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		if res.Kind == "ROLL" || res.Kind == "ERROR" {
+			return res
+		}
+	}
+}
+
+type playReply struct {
+	Kind         string `json:"kind"`
+	Code         int    `json:"code"`
+	Result       string `json:"result"`
+	Jackpot      int    `json:"jackpot"`
+	Contribution int    `json:"contribution"`
+}
+
+func TestRulesReload(t *testing.T) {
+	defer rules.Set(rules.Default())
+
+	old, a1 := dialAndAuth(t)
+	defer old.Close()
+	sMsg := startSession(t, old, a1.ClientId)
+	if sMsg.Rules == nil || sMsg.Rules.Version != "default" {
+		t.Fatalf("Expected the default rules but got %+v", sMsg.Rules)
+	}
+
+	r := rules.Default()
+	r.Version = "v2"
+	r.MinBet = 5
+	r.BetTypes[rules.HIGH] = &rules.Bet{Enabled: true, Pays: 2}
+	r.Features.Duels = false
+	err := rules.Set(r)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	// the session that was already running keeps its rules
+	if res := play(t, old, a1.ClientId, 2, "EVEN"); res.Kind != "ROLL" {
+		t.Errorf("Expected a ROLL under the old minimum but got %+v", res)
+	}
+	if res := play(t, old, a1.ClientId, 5, "HIGH"); res.Code != int(client.INVALID_CHOICE) {
+		t.Errorf("Expected INVALID_CHOICE under the old rules but got %+v", res)
+	}
+	history := client.FindClient(a1.ClientId).History()
+	if len(history) != 1 || history[0].RulesVersion != "default" {
+		t.Errorf("Expected 1 play with the default rules but got %+v", history)
+	}
+
+	// a new one gets the new ones
+	conn, a2 := dialAndAuth(t)
+	defer conn.Close()
+	sMsg = startSession(t, conn, a2.ClientId)
+	if sMsg.Rules == nil || sMsg.Rules.Version != "v2" {
+		t.Fatalf("Expected rules v2 but got %+v", sMsg.Rules)
+	}
+	if res := play(t, conn, a2.ClientId, 2, "EVEN"); res.Code != int(client.INVALID_BET) {
+		t.Errorf("Expected INVALID_BET under the new minimum but got %+v", res)
+	}
+	res := play(t, conn, a2.ClientId, 5, "HIGH")
+	if res.Kind != "ROLL" {
+		t.Fatalf("Expected a ROLL on HIGH but got %+v", res)
+	}
+	history = client.FindClient(a2.ClientId).History()
+	if len(history) != 1 || history[0].RulesVersion != "v2" {
+		t.Errorf("Expected 1 play with rules v2 but got %+v", history)
+	}
+
+	err = conn.WriteJSON(&EndPlayMessage{Kind: "ENDPLAY", ClientId: a2.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	eMsg := &client.EndPlayResultMessage{}
+	readUntil(t, conn, "ENDPLAY", eMsg)
+	want := -5
+	if res.Result == "WIN" {
+		want = 10
+	}
+	want -= res.Contribution
+	if eMsg.Profit != want {
+		t.Errorf("Expected profit %d after a %s paying 2 to 1 but got %d", want, res.Result, eMsg.Profit)
+	}
+
+	err = conn.WriteJSON(&DuelMessage{Kind: "CHALLENGE", ClientId: a2.ClientId, Opponent: a1.Profile.DisplayName, Bet: 10})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.FEATURE_DISABLED {
+		t.Errorf("Expected FEATURE_DISABLED but got %d", cErr.Code)
+	}
+}
+
+func TestIdleExpiry(t *testing.T) {
+	client.IdleTimeout = 400 * time.Millisecond
+	client.IdleWarning = 200 * time.Millisecond
+	defer func() {
+		client.IdleTimeout = 5 * time.Minute
+		client.IdleWarning = 30 * time.Second
+	}()
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+
+	wMsg := &client.IdleWarningMessage{}
+	readUntil(t, conn, "IDLEWARNING", wMsg)
+	if wMsg.ExpiresIn != 200 {
+		t.Errorf("Expected expiresIn 200 but got %d", wMsg.ExpiresIn)
+	}
+
+	// a message after the warning starts over
+	getWallet(t, conn, a.ClientId)
+	time.Sleep(300 * time.Millisecond)
+	if client.FindClient(a.ClientId) == nil {
+		t.Fatalf("Expected the client to be kept after a message")
+	}
+
+	readUntil(t, conn, "IDLEWARNING", wMsg)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("Expected a normal close but got %+v", err)
+		}
+		break
+	}
+	if client.FindClient(a.ClientId) != nil {
+		t.Errorf("Expected the client to be removed")
+	}
+}
+
+func TestPongTimeout(t *testing.T) {
+	handlers.PingInterval = 50 * time.Millisecond
+	handlers.PongTimeout = 200 * time.Millisecond
+	defer func() {
+		handlers.PingInterval = 30 * time.Second
+		handlers.PongTimeout = 60 * time.Second
+	}()
+
+	// pongs are only sent while reading
+	reading, a := dialAndAuth(t)
+	defer reading.Close()
+	msgs := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := reading.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			msgs <- data
+		}
+	}()
+
+	silent, _ := dialAndAuth(t)
+	defer silent.Close()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("Expected a connection that answers pings to stay open but got %+v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err := reading.WriteJSON(&WalletMessage{Kind: "WALLET", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	select {
+	case data := <-msgs:
+		if !strings.Contains(string(data), `"WALLET"`) {
+			t.Errorf("Expected WALLET but got %s", data)
+		}
+	case err := <-errs:
+		t.Fatalf("Error: %+v", err)
+	}
+
+	// the silent one was dropped, what's left are the pings it never answered
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := silent.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Errorf("Expected the server to close the connection")
+			}
+			break
+		}
+	}
+}
+
+func TestSettleOnExpiry(t *testing.T) {
+	client.BcryptCost = bcrypt.MinCost
+	client.IdleTimeout = 300 * time.Millisecond
+	client.IdleWarning = 100 * time.Millisecond
+	username := "user-" + uuid.NewString()[:8]
+
+	conn, a := dialAndAuth(t)
+	err := conn.WriteJSON(&AccountMessage{Kind: "REGISTER", ClientId: a.ClientId, Username: username, Password: "hunter22"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "REGISTER", &client.AccountResultMessage{})
+	startSession(t, conn, a.ClientId)
+	res := play(t, conn, a.ClientId, 10, "EVEN")
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.FindClient(a.ClientId) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the client to expire")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	client.IdleTimeout = 5 * time.Minute
+	client.IdleWarning = 30 * time.Second
+
+	conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer conn.Close()
+	err = conn.WriteJSON(&AccountMessage{Kind: "LOGIN", Username: username, Password: "hunter22"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	readUntil(t, conn, "LOGIN", &client.AccountResultMessage{})
+
+	sMsg := &client.SettledMessage{}
+	readUntil(t, conn, "SETTLED", sMsg)
+	want := -10
+	if res.Result == "WIN" {
+		want = 10
+	}
+	want -= res.Contribution
+	if sMsg.Reason != client.SettledExpired || sMsg.Profit != want || sMsg.Wallet != 100+want {
+		t.Errorf("Expected an EXPIRED settlement of %d but got %+v", want, sMsg)
+	}
+	if len(sMsg.History) != 1 || sMsg.History[0].Result != res.Result {
+		t.Errorf("Expected the play in the history but got %+v", sMsg.History)
+	}
+	if w := getWallet(t, conn, a.ClientId); w != 100+want {
+		t.Errorf("Expected wallet %d but got %d", 100+want, w)
+	}
+}
+
+func TestSettleOnDisconnect(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+	startSession(t, conn, a.ClientId)
+	res := play(t, conn, a.ClientId, 10, "ODD")
+
+	client.St.DisconnectClient(context.Background(), client.FindClient(a.ClientId))
+
+	// told before the connection is closed
+	sMsg := &client.SettledMessage{}
+	readUntil(t, conn, "SETTLED", sMsg)
+	want := -10
+	if res.Result == "WIN" {
+		want = 10
+	}
+	want -= res.Contribution
+	if sMsg.Reason != client.SettledDisconnected || sMsg.Profit != want || sMsg.Wallet != 100+want {
+		t.Errorf("Expected a DISCONNECTED settlement of %d but got %+v", want, sMsg)
+	}
+}
+
+func TestSettleAll(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+	startSession(t, conn, a.ClientId)
+	play(t, conn, a.ClientId, 10, "ODD")
+
+	client.St.SettleAll(client.SettledShutdown)
+	sMsg := &client.SettledMessage{}
+	readUntil(t, conn, "SETTLED", sMsg)
+	if sMsg.Reason != client.SettledShutdown {
+		t.Errorf("Expected SHUTDOWN but got %s", sMsg.Reason)
+	}
+	if client.FindClient(a.ClientId).Playing() {
+		t.Errorf("Expected the session to be over")
+	}
+
+	// settled once, ending it again finds nothing
+	err := conn.WriteJSON(&EndPlayMessage{Kind: "ENDPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.NOT_PLAYING {
+		t.Errorf("Expected NOT_PLAYING but got %d", cErr.Code)
+	}
+}
+
+func TestGuestSettlementNotKept(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	startSession(t, conn, a.ClientId)
+	play(t, conn, a.ClientId, 10, "ODD")
+	conn.Close()
+
+	c := client.FindClient(a.ClientId)
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Online() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the guest to go offline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.St.SettleAll(client.SettledShutdown)
+
+	// nothing waiting for the next device, the wallet already has it
+	conn = dialDevice(t, a.ClientId, false)
+	defer conn.Close()
+	readUntil(t, conn, "AUTH", &client.AuthResultMessage{})
+	err := conn.WriteJSON(&WalletMessage{Kind: "WALLET", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	for {
+		msg := &AuthMessage{}
+		err := conn.ReadJSON(msg)
+		if err != nil {
+			t.Fatalf("Error: %+v", err)
+		}
+		if msg.Kind == "SETTLED" {
+			t.Fatalf("Expected no settlement for a guest")
+		}
+		if msg.Kind == "WALLET" {
+			break
+		}
+	}
+}
+
+func playWithKey(t *testing.T, conn *websocket.Conn, id string, bet int, choice, key string) *client.PlayResultMessage {
+	err := conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: id, Bet: bet, Choice: choice, IdempotencyKey: key})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	pMsg := &client.PlayResultMessage{}
+	readUntil(t, conn, "ROLL", pMsg)
+	return pMsg
+}
+
+func TestPlayIdempotencyKey(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+	startSession(t, conn, a.ClientId)
+
+	first := playWithKey(t, conn, a.ClientId, 10, "ODD", "play-1")
+	if first.Replayed || first.IdempotencyKey != "play-1" {
+		t.Errorf("Expected a fresh roll for play-1 but got %+v", first)
+	}
+	retry := playWithKey(t, conn, a.ClientId, 10, "ODD", "play-1")
+	if !retry.Replayed || retry.Roll != first.Roll || retry.Result != first.Result {
+		t.Errorf("Expected the first result replayed but got %+v after %+v", retry, first)
+	}
+
+	res := play(t, conn, a.ClientId, 20, "ODD")
+	if res.Kind != "ROLL" {
+		t.Fatalf("Expected a ROLL without a key but got %+v", res)
+	}
+	err := conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 20, Choice: "ODD", IdempotencyKey: "play-1"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cErr := &client.ErrorResultMessage{}
+	readUntil(t, conn, "ERROR", cErr)
+	if cErr.Code != client.IDEMPOTENCY_KEY_REUSED {
+		t.Errorf("Expected IDEMPOTENCY_KEY_REUSED but got %d", cErr.Code)
+	}
+
+	// a play that was refused doesn't use up its key
+	if res := play(t, conn, a.ClientId, 1000, "ODD"); res.Code != int(client.NO_BALANCE) {
+		t.Fatalf("Expected NO_BALANCE but got %+v", res)
+	}
+	if r := playWithKey(t, conn, a.ClientId, 5, "EVEN", "play-2"); r.Replayed {
+		t.Errorf("Expected play-2 to roll but got %+v", r)
+	}
+
+	history := client.FindClient(a.ClientId).History()
+	if len(history) != 3 {
+		t.Errorf("Expected 3 plays but got %+v", history)
+	}
+}
+
+func TestPlayIdempotencyRetention(t *testing.T) {
+	client.IdempotencyKeys = 2
+	defer func() { client.IdempotencyKeys = 100 }()
+
+	conn, a := dialAndAuth(t)
+	defer conn.Close()
+	startSession(t, conn, a.ClientId)
+
+	for _, key := range []string{"a", "b", "c"} {
+		playWithKey(t, conn, a.ClientId, 1, "ODD", key)
+	}
+	if r := playWithKey(t, conn, a.ClientId, 1, "ODD", "c"); !r.Replayed {
+		t.Errorf("Expected c to be kept but got %+v", r)
+	}
+	if r := playWithKey(t, conn, a.ClientId, 1, "ODD", "a"); r.Replayed {
+		t.Errorf("Expected a to be dropped but got %+v", r)
+	}
+}
+
+func TestPlayRetryAfterDisconnect(t *testing.T) {
+	conn, a := dialAndAuth(t)
+	startSession(t, conn, a.ClientId)
+
+	// the connection drops before the ROLL comes back
+	err := conn.WriteJSON(&client.PlayMessage{Kind: "PLAY", ClientId: a.ClientId, Bet: 10, Choice: "EVEN", IdempotencyKey: "lost"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	conn.Close()
+
+	conn = dialDevice(t, a.ClientId, false)
+	defer conn.Close()
+	retry := playWithKey(t, conn, a.ClientId, 10, "EVEN", "lost")
+
+	// whichever got there first rolled, the other one didn't
+	history := client.FindClient(a.ClientId).History()
+	if len(history) != 1 || history[0].Roll != retry.Roll {
+		t.Errorf("Expected one play rolling %d but got %+v", retry.Roll, history)
+	}
+
+	err = conn.WriteJSON(&EndPlayMessage{Kind: "ENDPLAY", ClientId: a.ClientId})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	eMsg := &client.EndPlayResultMessage{}
+	readUntil(t, conn, "ENDPLAY", eMsg)
+	if p := eMsg.Profit + retry.Contribution; p != 10 && p != -10 {
+		t.Errorf("Expected a single bet of 10 settled but got %d", eMsg.Profit)
+	}
+
+	// still the same answer once the session is over
+	if r := playWithKey(t, conn, a.ClientId, 10, "EVEN", "lost"); !r.Replayed || r.Roll != retry.Roll {
+		t.Errorf("Expected the original roll %d replayed but got %+v", retry.Roll, r)
+	}
+}
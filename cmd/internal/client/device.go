@@ -0,0 +1,349 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"cgoncalveslck/dicegame/cmd/internal/tracing"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// How many connections a client can have open at once, 0 means no limit
+var MaxDevices = 5
+
+// One connection of a client, a player on their phone and laptop is one
+// client with two devices
+type Device struct {
+	Id       string          `json:"id"`
+	Conn     *websocket.Conn `json:"-"`
+	Ip       string          `json:"ip"`
+	LoggedAt time.Time       `json:"loggedAt"`
+
+	mx      sync.Mutex // websocket writes, tables broadcast from other goroutines
+	connLog *slog.Logger
+	log     atomic.Pointer[slog.Logger] // connLog plus the clientId once there is one
+}
+
+// Pushed to the other devices of a client when a new one logs in
+type DeviceLoginMessage struct {
+	Kind    string  `json:"kind"`
+	Device  *Device `json:"device"`
+	Devices int     `json:"devices"` // connected devices, the new one included
+}
+
+// Pushed to a device right before it's closed to make room for a new one
+type KickedMessage struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func NewDevice(conn *websocket.Conn) *Device {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+
+	d := &Device{
+		Id:       uuid.NewString(),
+		Conn:     conn,
+		Ip:       ip,
+		LoggedAt: time.Now(),
+	}
+	d.connLog = slog.With(slog.String("conn", d.Id), slog.String("remote", conn.RemoteAddr().String()))
+	d.log.Store(d.connLog)
+	return d
+}
+
+// Logger for everything about this connection
+func (d *Device) Log() *slog.Logger {
+	return d.log.Load()
+}
+
+// Adds clientId to the connection's log lines, called when the connection
+// logs in as a client
+func (d *Device) Identify(clientId string) {
+	d.log.Store(d.connLog.With(slog.String("clientId", clientId)))
+}
+
+func (d *Device) send(data []byte) error {
+	d.mx.Lock()
+	start := time.Now()
+	err := d.Conn.WriteMessage(websocket.TextMessage, data)
+	metrics.SendDuration.Observe(time.Since(start).Seconds())
+	d.mx.Unlock()
+
+	// only the kind, the rest can hold ids and tokens
+	if err == nil && d.Log().Enabled(context.Background(), slog.LevelDebug) {
+		var kind struct {
+			Kind string `json:"kind"`
+		}
+		json.Unmarshal(data, &kind)
+		d.Log().Debug("Sent message", slog.String("message", kind.Kind))
+	}
+	return err
+}
+
+// Sends msg to this device only, for replies that make no sense on the others
+func (d *Device) SendMessage(msg interface{}) error {
+	countError(msg)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return d.send(data)
+}
+
+// SendMessage under its own span when ctx is traced
+func (d *Device) SendMessageContext(ctx context.Context, msg interface{}) error {
+	_, span := tracing.StartChild(ctx, "Device.SendMessage")
+	defer span.End()
+
+	err := d.SendMessage(msg)
+	tracing.Error(span, err)
+	return err
+}
+
+// Pings the connection every interval until done is closed, the handler's
+// pong handler pushes the read deadline back when the answer comes
+func (d *Device) KeepAlive(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// control frames can be written alongside send, no need for d.mx
+		err := d.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+		if err != nil {
+			// the read side notices the dead connection by its deadline
+			d.Log().Debug("Ping failed", slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// Sends a close frame and closes the connection
+// The handler reading from it notices and detaches the device
+func (d *Device) Close(code int, text string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+	d.Conn.Close()
+}
+
+// Closes every connection of every client in the store with code, their
+// handlers detach them as usual
+func (s *Store) CloseAll(code int, text string) {
+	s.Mx.Lock()
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, c := range s.Clients {
+		clients = append(clients, c)
+	}
+	s.Mx.Unlock()
+
+	for _, c := range clients {
+		for _, d := range c.devices() {
+			d.Close(code, text)
+		}
+	}
+}
+
+// Snapshot of the connected devices, safe to use without c.mx
+func (c *Client) devices() []*Device {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return append([]*Device(nil), c.Devices...)
+}
+
+// True while the client has at least one connection
+func (c *Client) Online() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return len(c.Devices) > 0
+}
+
+// Adds d to the client's devices
+// When they're all taken the oldest one is returned to be kicked if kick is
+// set, otherwise d isn't added and ok is false
+func (c *Client) attach(d *Device, kick bool) (kicked *Device, ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if MaxDevices > 0 && len(c.Devices) >= MaxDevices {
+		if !kick {
+			return nil, false
+		}
+		// appended in login order so the first one is the oldest
+		kicked = c.Devices[0]
+		c.Devices = c.Devices[1:]
+	}
+
+	c.Devices = append(c.Devices, d)
+	return kicked, true
+}
+
+// Removes d from the client's devices, called when its connection ends
+// The client stays in the store until it expires so it can reconnect, but
+// with nobody left to play for it it leaves its table and duels right away
+// A running session is left alone so a PLAY can be retried after
+// reconnecting, it's settled as EXPIRED if nobody does within IdleTimeout
+func (c *Client) Detach(d *Device) {
+	c.mx.Lock()
+	last := false
+	for i, cd := range c.Devices {
+		if cd == d {
+			c.Devices = append(c.Devices[:i], c.Devices[i+1:]...)
+			last = len(c.Devices) == 0
+			break
+		}
+	}
+	c.mx.Unlock()
+
+	if !last || c.Id == "" {
+		return
+	}
+
+	// has to happen without c.mx, both lock it themselves
+	if t := c.SeatedAt(); t != nil {
+		t.Leave(c)
+	}
+	cancelDuelsOf(c)
+
+	slog.Debug("Client offline", slog.String("clientId", c.Id))
+}
+
+// Logs d in as an existing client, returns the client the connection
+// belongs to from now on
+func (c *Client) loginDevice(ctx context.Context, d *Device, msg *DefaultMessage) *Client {
+	St.Mx.Lock()
+	existing, found := St.Clients[msg.ClientId]
+	// the id alone would let anyone who knows it in
+	denied := found && existing.registered() && !St.redeemLoginToken(msg.Token, existing)
+	St.Mx.Unlock()
+	if denied {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "log in with LOGIN or the identity provider",
+			Code:    LOGIN_REQUIRED,
+		}
+		reason := "no login token"
+		if msg.Token != "" {
+			cErr.Message = "invalid or expired login token"
+			cErr.Code = INVALID_CREDENTIALS
+			reason = "invalid login token"
+		}
+		audit.WriteContext(ctx, audit.Entry{Event: "login_failed", ClientId: existing.Id, Data: map[string]interface{}{"device": d.Id, "ip": d.Ip, "reason": reason}})
+
+		err := d.SendMessageContext(ctx, cErr)
+		if err != nil {
+			d.Log().Warn("SendMessage failed", slog.Any("error", err))
+		}
+		return c
+	}
+	if !found {
+		// expired between HandleClientID and here
+		err := d.SendMessageContext(ctx, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "client not found",
+			Code:    CLIENT_NOT_FOUND,
+		})
+		if err != nil {
+			d.Log().Warn("SendMessage failed", slog.Any("error", err))
+		}
+		return c
+	}
+
+	if !c.moveDevice(ctx, d, existing, msg.Kick) {
+		return c
+	}
+
+	profile := existing.ProfileSnapshot()
+	err := d.SendMessageContext(ctx, &AuthResultMessage{
+		Kind:     "AUTH",
+		ClientId: existing.Id,
+		Profile:  &profile,
+	})
+	if err != nil {
+		d.Log().Warn("SendMessage failed", slog.Any("error", err))
+	}
+	existing.reportSettled(ctx, d)
+
+	return existing
+}
+
+// Moves d from c to target, kicking target's oldest device if needed and
+// telling the others about the new one
+// False when target has no room, d stays with c and has been told why
+func (c *Client) moveDevice(ctx context.Context, d *Device, target *Client, kick bool) bool {
+	kicked, ok := target.attach(d, kick)
+	if !ok {
+		err := d.SendMessageContext(ctx, &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "too many devices, log in with kick to replace the oldest one",
+			Code:    TOO_MANY_DEVICES,
+		})
+		if err != nil {
+			d.Log().Warn("SendMessage failed", slog.Any("error", err))
+		}
+		return false
+	}
+	c.Detach(d)
+	target.Touch()
+
+	if kicked != nil {
+		err := kicked.SendMessageContext(ctx, &KickedMessage{
+			Kind:    "KICKED",
+			Message: "logged in on another device",
+		})
+		if err != nil {
+			kicked.Log().Warn("SendMessage failed", slog.Any("error", err))
+		}
+		kicked.Close(websocket.CloseNormalClosure, "kicked")
+
+		kicked.Log().Info("Device kicked")
+	}
+
+	others := target.devices()
+	login := &DeviceLoginMessage{
+		Kind:    "DEVICELOGIN",
+		Device:  d,
+		Devices: len(others),
+	}
+	for _, o := range others {
+		if o == d {
+			continue
+		}
+		err := o.SendMessageContext(ctx, login)
+		if err != nil {
+			o.Log().Warn("SendMessage failed", slog.Any("error", err))
+		}
+	}
+
+	d.Identify(target.Id)
+	d.Log().Info("Device logged in", slog.Int("devices", len(others)))
+	data := map[string]interface{}{
+		"device":  d.Id,
+		"ip":      d.Ip,
+		"devices": len(others),
+	}
+	if kicked != nil {
+		data["kicked"] = kicked.Id
+	}
+	audit.WriteContext(ctx, audit.Entry{Event: "device_login", ClientId: target.Id, Data: data})
+	return true
+}
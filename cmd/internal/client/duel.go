@@ -0,0 +1,376 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long the opponent has to answer a challenge
+var DuelTimeout = 30 * time.Second
+
+// Percentage of the pot kept by the house, 0 pays the whole pot
+var DuelRake = 0
+
+// Two players put up the same stake, both roll and the highest roll takes the pot
+// Stakes are held by the duel (taken out of the wallets) until it's settled or refunded
+type Duel struct {
+	Id         string
+	Challenger *Client
+	Opponent   *Client
+	Stake      int
+	ExpiresAt  time.Time
+
+	done  bool
+	timer *time.Timer
+	mx    sync.Mutex
+}
+
+type ChallengeResultMessage struct {
+	Kind      string `json:"kind"`
+	DuelId    string `json:"duelId"`
+	Opponent  string `json:"opponent"`
+	Bet       int    `json:"bet"`
+	ExpiresIn int    `json:"expiresIn"` // seconds
+}
+
+type ChallengedMessage struct {
+	Kind       string `json:"kind"`
+	DuelId     string `json:"duelId"`
+	Challenger string `json:"challenger"`
+	Bet        int    `json:"bet"`
+	ExpiresIn  int    `json:"expiresIn"` // seconds
+}
+
+type DuelResultMessage struct {
+	Kind           string `json:"kind"`
+	DuelId         string `json:"duelId"`
+	Challenger     string `json:"challenger"`
+	Opponent       string `json:"opponent"`
+	ChallengerRoll int    `json:"challengerRoll"`
+	OpponentRoll   int    `json:"opponentRoll"`
+	Winner         string `json:"winner"`
+	Pot            int    `json:"pot"`
+	Rake           int    `json:"rake"`
+	Payout         int    `json:"payout"`
+}
+
+// Sent to both players when a duel ends without a roll
+type DuelCancelledMessage struct {
+	Kind   string `json:"kind"`
+	DuelId string `json:"duelId"`
+	Reason string `json:"reason"` // DECLINED, EXPIRED or ABANDONED
+	Refund int    `json:"refund"`
+}
+
+// Marks the duel as finished, false if something else got to it first
+// Accept, decline, timeout and disconnect can all race for the same duel
+func (d *Duel) finish() bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.done {
+		return false
+	}
+	d.done = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+
+	St.Mx.Lock()
+	delete(St.Duels, d.Id)
+	St.Mx.Unlock()
+	return true
+}
+
+// Refunds the challenger's stake and tells both players why
+func (d *Duel) cancel(ctx context.Context, reason string) {
+	if !d.finish() {
+		return
+	}
+
+	d.Challenger.Credit(d.Stake, "duel_refund")
+	d.Challenger.recordBet(-d.Stake, d.Stake)
+
+	msg := &DuelCancelledMessage{
+		Kind:   "DUELCANCELLED",
+		DuelId: d.Id,
+		Reason: reason,
+	}
+	broadcastContext(ctx, []*Client{d.Opponent}, msg)
+
+	refund := *msg
+	refund.Refund = d.Stake
+	broadcastContext(ctx, []*Client{d.Challenger}, &refund)
+
+	logging.FromContext(ctx).Debug("Duel cancelled", slog.String("duel", d.Id), slog.String("reason", reason))
+}
+
+// Both stakes are escrowed at this point, rolls until someone wins
+func (d *Duel) resolve(ctx context.Context) *DuelResultMessage {
+	cRoll, oRoll := rollDice(), rollDice()
+	for cRoll == oRoll {
+		cRoll, oRoll = rollDice(), rollDice()
+	}
+
+	pot := d.Stake * 2
+	rake := pot * DuelRake / 100
+
+	winner := d.Challenger
+	if oRoll > cRoll {
+		winner = d.Opponent
+	}
+	winner.Credit(pot-rake, "duel_win")
+	winner.recordBet(0, pot-rake)
+
+	logging.FromContext(ctx).Debug("Duel settled", slog.String("duel", d.Id), slog.String("winnerId", winner.Id), slog.Int("pot", pot), slog.Int("rake", rake))
+	return &DuelResultMessage{
+		Kind:           "DUELRESULT",
+		DuelId:         d.Id,
+		Challenger:     d.Challenger.DisplayName(),
+		Opponent:       d.Opponent.DisplayName(),
+		ChallengerRoll: cRoll,
+		OpponentRoll:   oRoll,
+		Winner:         winner.DisplayName(),
+		Pot:            pot,
+		Rake:           rake,
+		Payout:         pot - rake,
+	}
+}
+
+// Refunds every open duel c is part of, called when c goes away
+func cancelDuelsOf(c *Client) {
+	St.Mx.Lock()
+	var duels []*Duel
+	for _, d := range St.Duels {
+		if d.Challenger == c || d.Opponent == c {
+			duels = append(duels, d)
+		}
+	}
+	St.Mx.Unlock()
+
+	for _, d := range duels {
+		d.cancel(context.Background(), "ABANDONED")
+	}
+}
+
+func findDuel(id string, c *Client) *Duel {
+	St.Mx.Lock()
+	defer St.Mx.Unlock()
+
+	d, ok := St.Duels[id]
+	if !ok || (d.Challenger != c && d.Opponent != c) {
+		return nil
+	}
+	return d
+}
+
+func (c *Client) Challenge(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "CHALLENGE" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	r := rules.Current()
+	if !r.Features.Duels {
+		return featureDisabled("Duels"), nil
+	}
+
+	// the same bounds as any other bet
+	var eMessage string
+	switch {
+	case msg.Bet < r.MinBet:
+		eMessage = "Invalid bet (minimum " + strconv.Itoa(r.MinBet) + ")"
+	case r.MaxBet > 0 && msg.Bet > r.MaxBet:
+		eMessage = "Invalid bet (maximum " + strconv.Itoa(r.MaxBet) + ")"
+	}
+	if eMessage != "" {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: eMessage,
+			Code:    INVALID_BET,
+		}
+
+		return cErr, nil
+	}
+
+	// players only know each other by display name, client ids stay private
+	St.Mx.Lock()
+	var opponent *Client
+	for _, o := range St.Clients {
+		if strings.EqualFold(o.DisplayName(), msg.Opponent) {
+			opponent = o
+			break
+		}
+	}
+	St.Mx.Unlock()
+
+	if opponent == nil || opponent == c {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid opponent",
+			Code:    INVALID_OPPONENT,
+		}
+
+		return cErr, nil
+	}
+
+	// nobody there to answer, the stake would only be tied up until it expires
+	if !opponent.Online() {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Opponent is offline",
+			Code:    INVALID_OPPONENT,
+		}
+
+		return cErr, nil
+	}
+
+	if cErr := c.checkLimits(msg.Bet); cErr != nil {
+		return cErr, nil
+	}
+
+	if !c.Debit(msg.Bet, "duel_stake") {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Insufficient points",
+			Code:    NO_BALANCE,
+		}
+
+		return cErr, nil
+	}
+	c.recordBet(msg.Bet, -msg.Bet)
+
+	d := &Duel{
+		Id:         uuid.NewString(),
+		Challenger: c,
+		Opponent:   opponent,
+		Stake:      msg.Bet,
+		ExpiresAt:  time.Now().Add(DuelTimeout),
+	}
+
+	St.Mx.Lock()
+	St.Duels[d.Id] = d
+	St.Mx.Unlock()
+
+	d.mx.Lock()
+	d.timer = time.AfterFunc(DuelTimeout, func() {
+		d.cancel(context.Background(), "EXPIRED")
+	})
+	d.mx.Unlock()
+
+	err := c.SendMessageContext(ctx, &ChallengeResultMessage{
+		Kind:      "CHALLENGE",
+		DuelId:    d.Id,
+		Opponent:  opponent.DisplayName(),
+		Bet:       d.Stake,
+		ExpiresIn: int(DuelTimeout.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	broadcastContext(ctx, []*Client{opponent}, &ChallengedMessage{
+		Kind:       "CHALLENGED",
+		DuelId:     d.Id,
+		Challenger: c.DisplayName(),
+		Bet:        d.Stake,
+		ExpiresIn:  int(DuelTimeout.Seconds()),
+	})
+
+	logging.FromContext(ctx).Debug("Duel challenge", slog.String("duel", d.Id), slog.String("opponentId", opponent.Id), slog.Int("bet", d.Stake))
+	return nil, nil
+}
+
+func (c *Client) AcceptDuel(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "ACCEPT" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	d := findDuel(msg.DuelId, c)
+	if d == nil || d.Opponent != c {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Duel not found",
+			Code:    DUEL_NOT_FOUND,
+		}
+
+		return cErr, nil
+	}
+
+	if cErr := c.checkLimits(d.Stake); cErr != nil {
+		return cErr, nil
+	}
+
+	// escrow before claiming the duel so a failed debit leaves it open
+	if !c.Debit(d.Stake, "duel_stake") {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Insufficient points",
+			Code:    NO_BALANCE,
+		}
+
+		return cErr, nil
+	}
+	c.recordBet(d.Stake, -d.Stake)
+
+	if !d.finish() {
+		c.Credit(d.Stake, "duel_refund")
+		c.recordBet(-d.Stake, d.Stake)
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Duel not found",
+			Code:    DUEL_NOT_FOUND,
+		}
+
+		return cErr, nil
+	}
+
+	broadcastContext(ctx, []*Client{d.Challenger, d.Opponent}, d.resolve(ctx))
+	return nil, nil
+}
+
+// Either player can decline, the challenger declining withdraws the challenge
+func (c *Client) DeclineDuel(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "DECLINE" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	d := findDuel(msg.DuelId, c)
+	if d == nil {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Duel not found",
+			Code:    DUEL_NOT_FOUND,
+		}
+
+		return cErr, nil
+	}
+
+	d.cancel(ctx, "DECLINED")
+	return nil, nil
+}
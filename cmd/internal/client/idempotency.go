@@ -0,0 +1,109 @@
+package client
+
+import (
+	"time"
+)
+
+// How many PLAY idempotency keys a client keeps and for how long, a retry
+// with an older key rolls again
+var (
+	IdempotencyKeys = 100
+	IdempotencyTTL  = time.Hour
+)
+
+const MaxIdempotencyKeyLength = 64
+
+// One PLAY by its idempotency key
+type playKey struct {
+	key    string
+	bet    int
+	choice string
+	at     time.Time
+
+	done   chan struct{}      // closed once the play is over
+	result *PlayResultMessage // set before done is closed, nil when it didn't roll
+}
+
+// Recent PLAY keys of a client, guarded by the client's mx
+type playKeys struct {
+	keys  map[string]*playKey
+	order []*playKey // oldest first
+}
+
+// Drops keys past IdempotencyTTL and the oldest ones over IdempotencyKeys
+// Caller must hold c.mx
+func (pk *playKeys) expire(now time.Time) {
+	for len(pk.order) > 0 {
+		oldest := pk.order[0]
+		if now.Sub(oldest.at) < IdempotencyTTL && len(pk.order) <= IdempotencyKeys {
+			return
+		}
+		// a key released and claimed again is a newer entry
+		if pk.keys[oldest.key] == oldest {
+			delete(pk.keys, oldest.key)
+		}
+		pk.order = pk.order[1:]
+	}
+}
+
+// Claims key for a PLAY of bet on choice
+// The first PLAY with a key gets it and must call finishKey, a duplicate waits
+// for the first one and gets its result, or claims the key itself if the
+// first one didn't roll
+func (c *Client) claimKey(key string, bet int, choice string) (k *playKey, replay *PlayResultMessage, cErr *ErrorResultMessage) {
+	if len(key) > MaxIdempotencyKeyLength {
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid idempotency key (at most 64 characters)",
+			Code:    INVALID_JASON,
+		}
+		return nil, nil, cErr
+	}
+
+	for {
+		c.mx.Lock()
+		if c.playKeys == nil {
+			c.playKeys = &playKeys{keys: make(map[string]*playKey)}
+		}
+		now := time.Now()
+		c.playKeys.expire(now)
+		existing, ok := c.playKeys.keys[key]
+		if !ok {
+			k = &playKey{key: key, bet: bet, choice: choice, at: now, done: make(chan struct{})}
+			c.playKeys.keys[key] = k
+			c.playKeys.order = append(c.playKeys.order, k)
+			c.mx.Unlock()
+			return k, nil, nil
+		}
+		c.mx.Unlock()
+
+		if existing.bet != bet || existing.choice != choice {
+			cErr = &ErrorResultMessage{
+				Kind:    "ERROR",
+				Message: "Idempotency key already used for a different play",
+				Code:    IDEMPOTENCY_KEY_REUSED,
+			}
+			return nil, nil, cErr
+		}
+
+		<-existing.done
+		if existing.result != nil {
+			return nil, existing.result, nil
+		}
+	}
+}
+
+// Ends the play that claimed k, result is nil when it didn't roll and the
+// key is free again
+func (c *Client) finishKey(k *playKey, result *PlayResultMessage) {
+	if result == nil {
+		c.mx.Lock()
+		if c.playKeys.keys[k.key] == k {
+			delete(c.playKeys.keys, k.key)
+		}
+		c.mx.Unlock()
+	}
+
+	k.result = result
+	close(k.done)
+}
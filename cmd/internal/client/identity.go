@@ -0,0 +1,53 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/identity"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"log/slog"
+)
+
+// Off makes AUTH without a clientId fail, players have to come in through
+// an account or an identity provider
+var AllowGuests = true
+
+type IdentityResultMessage struct {
+	Kind     string             `json:"kind"`
+	ClientId string             `json:"clientId"`
+	Identity *identity.Identity `json:"identity"`
+	Profile  *Profile           `json:"profile"`
+	Token    string             `json:"token"` // AUTH the socket with it and clientId
+}
+
+func identityKey(id *identity.Identity) string {
+	return id.Provider + "|" + id.Subject
+}
+
+// Client for someone a provider vouched for, created on their first login
+// Like accounts the client outlives its connections and is put back in the
+// store on every login
+func LoginIdentity(ctx context.Context, id *identity.Identity) *Client {
+	St.Mx.Lock()
+	c, ok := St.Identities[identityKey(id)]
+	if !ok {
+		c = &Client{identity: identityKey(id)}
+		c.Init()
+		St.Identities[identityKey(id)] = c
+	}
+	St.Clients[c.Id] = c
+	St.Mx.Unlock()
+	c.Touch()
+
+	logging.FromContext(ctx).Info("Identity logged in", slog.String("clientId", c.Id), slog.String("provider", id.Provider), slog.String("subject", id.Subject), slog.Bool("new", !ok))
+	audit.WriteContext(ctx, audit.Entry{
+		Event:    "identity_login",
+		ClientId: c.Id,
+		Data: map[string]interface{}{
+			"provider": id.Provider,
+			"subject":  id.Subject,
+			"new":      !ok,
+		},
+	})
+	return c
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Percentage of every PLAY stake that feeds the jackpot
+// It comes out of the player's result, the house doesn't add anything
+var JackpotPercent = 1
+
+// Consecutive sixes in a session needed to win the pool
+var JackpotStreak = 3
+
+// What the pool restarts at after it's won
+var JackpotSeed = 100
+
+// How often connected clients get the pool value, only sent when it changed
+var JackpotBroadcastInterval = 5 * time.Second
+
+type Jackpot struct {
+	Pool int `json:"pool"`
+	// contributions are in hundredths of a point so small bets still count
+	Fraction int `json:"fraction"`
+
+	changed bool
+	mx      sync.Mutex
+}
+
+type JackpotMessage struct {
+	Kind   string `json:"kind"`
+	Pool   int    `json:"pool"`
+	Winner string `json:"winner,omitempty"`
+	Won    int    `json:"won,omitempty"`
+}
+
+// Adds JackpotPercent of bet to the pool, returns the whole points that
+// went in so the player can be charged exactly that
+func (j *Jackpot) Contribute(bet int) int {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	j.Fraction += bet * JackpotPercent
+	points := j.Fraction / 100
+	j.Pool += points
+	j.Fraction %= 100
+	j.changed = true
+	return points
+}
+
+// Empties the pool back to the seed and returns what was in it
+func (j *Jackpot) Win() int {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	won := j.Pool
+	j.Pool = JackpotSeed
+	j.Fraction = 0
+	j.changed = true
+	return won
+}
+
+func (j *Jackpot) Value() int {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	return j.Pool
+}
+
+// Returns the pool and whether it changed since the last call
+func (j *Jackpot) poll() (int, bool) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	changed := j.changed
+	j.changed = false
+	return j.Pool, changed
+}
+
+// Counts a roll towards the session's streak of sixes, true when the
+// streak is long enough to win the pool
+// The caller holds c.mx
+func (s *Session) countSix(num int) bool {
+	if num != 6 {
+		s.Sixes = 0
+		return false
+	}
+
+	s.Sixes++
+	if s.Sixes < JackpotStreak {
+		return false
+	}
+
+	s.Sixes = 0
+	return true
+}
+
+// Pays c the pool and tells everyone, returns what was won
+func (c *Client) winJackpot(ctx context.Context) int {
+	won := St.Jackpot.Win()
+	c.Credit(won, "jackpot_win")
+	metrics.Payout(won)
+
+	broadcastContext(ctx, St.connected(), &JackpotMessage{
+		Kind:   "JACKPOT",
+		Pool:   St.Jackpot.Value(),
+		Winner: c.DisplayName(),
+		Won:    won,
+	})
+
+	logging.FromContext(ctx).Info("Jackpot won", slog.Int("won", won))
+	return won
+}
+
+// Every client with a connection
+func (s *Store) connected() []*Client {
+	s.Mx.Lock()
+	defer s.Mx.Unlock()
+
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, c := range s.Clients {
+		if c.Online() {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// Keeps running for as long as the server does
+func JackpotUpdates() {
+	timer := time.NewTicker(JackpotBroadcastInterval)
+
+	for range timer.C {
+		pool, changed := St.Jackpot.poll()
+		if !changed {
+			continue
+		}
+
+		broadcast(St.connected(), &JackpotMessage{
+			Kind: "JACKPOT",
+			Pool: pool,
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// How long a loosened limit takes to apply, tightening is immediate
+var LimitLoosenDelay = 24 * time.Hour
+
+// Longest cool-off and self-exclusion a player can ask for
+const (
+	MaxCoolOffHours = 24 * 7
+	MaxExcludeDays  = 365 * 5
+)
+
+// Self-imposed limits, 0 means no limit
+// Loss and wager limits are rolling windows (last 24 hours / last 7 days)
+type Limits struct {
+	DailyLoss      int `json:"dailyLoss"`
+	WeeklyLoss     int `json:"weeklyLoss"`
+	DailyWager     int `json:"dailyWager"`
+	WeeklyWager    int `json:"weeklyWager"`
+	SessionMinutes int `json:"sessionMinutes"`
+}
+
+// Wagered and net result for one hour, enough resolution for daily and weekly windows
+type LedgerEntry struct {
+	Hour  time.Time `json:"hour"`
+	Wager int       `json:"wager"`
+	Net   int       `json:"net"`
+}
+
+type ResponsibleGambling struct {
+	Limits        Limits        `json:"limits"`
+	Pending       *Limits       `json:"pending,omitempty"` // loosened limits waiting for PendingAt
+	PendingAt     time.Time     `json:"pendingAt"`
+	CoolOffUntil  time.Time     `json:"coolOffUntil"`
+	ExcludedUntil time.Time     `json:"excludedUntil"`
+	Ledger        []LedgerEntry `json:"ledger"`
+}
+
+type LimitsResultMessage struct {
+	Kind          string    `json:"kind"`
+	Limits        Limits    `json:"limits"`
+	Pending       *Limits   `json:"pending,omitempty"`
+	PendingAt     time.Time `json:"pendingAt"`
+	CoolOffUntil  time.Time `json:"coolOffUntil"`
+	ExcludedUntil time.Time `json:"excludedUntil"`
+}
+
+// New value is stricter than the old one, 0 is no limit so it's the loosest
+func tighter(new, old int) bool {
+	if new == 0 {
+		return false
+	}
+	return old == 0 || new < old
+}
+
+func tighten(new, old int) int {
+	if tighter(new, old) {
+		return new
+	}
+	return old
+}
+
+// Applies pending limits once their delay is over, caller must hold c.mx
+func (rg *ResponsibleGambling) effective(now time.Time) Limits {
+	if rg.Pending != nil && !now.Before(rg.PendingAt) {
+		rg.Limits = *rg.Pending
+		rg.Pending = nil
+		rg.PendingAt = time.Time{}
+	}
+	return rg.Limits
+}
+
+// Tightened fields apply straight away, anything looser waits LimitLoosenDelay
+// Caller must hold c.mx
+func (rg *ResponsibleGambling) set(target Limits, now time.Time) {
+	cur := rg.effective(now)
+	cur.DailyLoss = tighten(target.DailyLoss, cur.DailyLoss)
+	cur.WeeklyLoss = tighten(target.WeeklyLoss, cur.WeeklyLoss)
+	cur.DailyWager = tighten(target.DailyWager, cur.DailyWager)
+	cur.WeeklyWager = tighten(target.WeeklyWager, cur.WeeklyWager)
+	cur.SessionMinutes = tighten(target.SessionMinutes, cur.SessionMinutes)
+	rg.Limits = cur
+
+	if cur == target {
+		rg.Pending = nil
+		rg.PendingAt = time.Time{}
+		return
+	}
+
+	rg.Pending = &target
+	rg.PendingAt = now.Add(LimitLoosenDelay)
+}
+
+// Wagered and lost (positive) since the given time, caller must hold c.mx
+func (rg *ResponsibleGambling) since(t time.Time) (wager int, loss int) {
+	for _, e := range rg.Ledger {
+		if e.Hour.Before(t.Truncate(time.Hour)) {
+			continue
+		}
+		wager += e.Wager
+		loss -= e.Net
+	}
+	return
+}
+
+// Records a settled bet, net is negative for a loss
+// Duel stakes and tournament buy-ins are recorded as lost when they're taken
+// so they count while in escrow, what comes back later is recorded with
+// wager 0 (a win) or -stake (a refund)
+func (c *Client) recordBet(wager int, net int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	rg := &c.Gambling
+	hour := time.Now().Truncate(time.Hour)
+	if n := len(rg.Ledger); n > 0 && rg.Ledger[n-1].Hour.Equal(hour) {
+		rg.Ledger[n-1].Wager += wager
+		rg.Ledger[n-1].Net += net
+	} else {
+		rg.Ledger = append(rg.Ledger, LedgerEntry{Hour: hour, Wager: wager, Net: net})
+	}
+
+	// a week is all any limit looks at
+	cutoff := hour.Add(-7 * 24 * time.Hour)
+	for len(rg.Ledger) > 0 && !rg.Ledger[0].Hour.After(cutoff) {
+		rg.Ledger = rg.Ledger[1:]
+	}
+}
+
+// Cool-off or self-exclusion, both block starting sessions and any bet
+func (c *Client) checkBlocked() *ErrorResultMessage {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	now := time.Now()
+	switch {
+	case now.Before(c.Gambling.ExcludedUntil):
+		return &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Self-excluded until " + c.Gambling.ExcludedUntil.Format(time.RFC3339),
+			Code:    SELF_EXCLUDED,
+		}
+	case now.Before(c.Gambling.CoolOffUntil):
+		return &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Cooling off until " + c.Gambling.CoolOffUntil.Format(time.RFC3339),
+			Code:    COOLING_OFF,
+		}
+	}
+	return nil
+}
+
+// Checks a bet against every limit assuming it's lost
+func (c *Client) checkLimits(bet int) *ErrorResultMessage {
+	if cErr := c.checkBlocked(); cErr != nil {
+		return cErr
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	now := time.Now()
+	rg := &c.Gambling
+	l := rg.effective(now)
+	dayWager, dayLoss := rg.since(now.Add(-24 * time.Hour))
+	weekWager, weekLoss := rg.since(now.Add(-7 * 24 * time.Hour))
+
+	var eMessage string
+	var code cError
+
+	switch {
+	case l.SessionMinutes > 0 && c.Session != nil && c.Session.Playing &&
+		now.Sub(c.Session.StartedAt) >= time.Duration(l.SessionMinutes)*time.Minute:
+		eMessage = "Session time limit reached"
+		code = SESSION_TIME_LIMIT
+	case l.DailyWager > 0 && dayWager+bet > l.DailyWager,
+		l.WeeklyWager > 0 && weekWager+bet > l.WeeklyWager:
+		eMessage = "Wager limit reached"
+		code = WAGER_LIMIT
+	case l.DailyLoss > 0 && dayLoss+bet > l.DailyLoss,
+		l.WeeklyLoss > 0 && weekLoss+bet > l.WeeklyLoss:
+		eMessage = "Loss limit reached"
+		code = LOSS_LIMIT
+	}
+
+	if code != 0 {
+		return &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: eMessage,
+			Code:    code,
+		}
+	}
+	return nil
+}
+
+// Sets limits, cool-off and self-exclusion. Sending none of them just returns the current state
+func (c *Client) SetLimits(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "LIMITS" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	l := msg.Limits
+	if (l != nil && (l.DailyLoss < 0 || l.WeeklyLoss < 0 || l.DailyWager < 0 || l.WeeklyWager < 0 || l.SessionMinutes < 0)) ||
+		msg.CoolOffHours < 0 || msg.CoolOffHours > MaxCoolOffHours ||
+		msg.ExcludeDays < 0 || msg.ExcludeDays > MaxExcludeDays {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid limits",
+			Code:    INVALID_LIMITS,
+		}
+
+		return cErr, nil
+	}
+
+	now := time.Now()
+	c.mx.Lock()
+	rg := &c.Gambling
+	if l != nil {
+		rg.set(*l, now)
+	}
+
+	// both can only ever be extended
+	if until := now.Add(time.Duration(msg.CoolOffHours) * time.Hour); msg.CoolOffHours > 0 && until.After(rg.CoolOffUntil) {
+		rg.CoolOffUntil = until
+	}
+	if until := now.AddDate(0, 0, msg.ExcludeDays); msg.ExcludeDays > 0 && until.After(rg.ExcludedUntil) {
+		rg.ExcludedUntil = until
+	}
+
+	lMsg := &LimitsResultMessage{
+		Kind:          "LIMITS",
+		Limits:        rg.effective(now),
+		Pending:       rg.Pending,
+		PendingAt:     rg.PendingAt,
+		CoolOffUntil:  rg.CoolOffUntil,
+		ExcludedUntil: rg.ExcludedUntil,
+	}
+	c.mx.Unlock()
+
+	err := c.SendMessageContext(ctx, lMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("Limits updated", slog.Any("limits", lMsg.Limits))
+	return nil, nil
+}
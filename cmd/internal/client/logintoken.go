@@ -0,0 +1,54 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+// How long the token an HTTP login answers with can be used to AUTH a socket
+var LoginTokenTTL = time.Minute
+
+// One-time proof that whoever AUTHs with it logged in to client over HTTP
+type loginToken struct {
+	client    *Client
+	expiresAt time.Time
+}
+
+// Token for c to AUTH a socket with, registered and identity clients can't
+// AUTH with their clientId alone
+func IssueLoginToken(c *Client) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	St.Mx.Lock()
+	defer St.Mx.Unlock()
+
+	now := time.Now()
+	for t, lt := range St.loginTokens {
+		if !now.Before(lt.expiresAt) {
+			delete(St.loginTokens, t)
+		}
+	}
+	St.loginTokens[token] = &loginToken{client: c, expiresAt: now.Add(LoginTokenTTL)}
+	return token
+}
+
+// Uses up token, true if it was issued for c and hasn't expired
+// Caller must hold s.Mx
+func (s *Store) redeemLoginToken(token string, c *Client) bool {
+	lt, ok := s.loginTokens[token]
+	if !ok || lt.client != c {
+		return false
+	}
+	delete(s.loginTokens, token)
+	return time.Now().Before(lt.expiresAt)
+}
+
+// Whether c needs more than its clientId to log a device in, accounts and
+// identities do, guests don't
+// Caller must hold St.Mx
+func (c *Client) registered() bool {
+	return c.account != nil || c.identity != ""
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	displayNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{3,20}$`)
+	avatarRe      = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+)
+
+type Preferences struct {
+	Sound               bool   `json:"sound"`
+	Theme               string `json:"theme"`               // "light", "dark" or empty for the UI default
+	RealityCheckMinutes int    `json:"realityCheckMinutes"` // 0 uses RealityCheckInterval
+}
+
+type Profile struct {
+	DisplayName string      `json:"displayName"`
+	Avatar      string      `json:"avatar"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	Preferences Preferences `json:"preferences"`
+}
+
+type ProfileResultMessage struct {
+	Kind    string  `json:"kind"`
+	Profile Profile `json:"profile"`
+}
+
+// Gives every new client a name so there's always something to show
+func NewProfile(id string) Profile {
+	return Profile{
+		DisplayName: "player-" + id[:8],
+		Avatar:      "default",
+		CreatedAt:   time.Now(),
+	}
+}
+
+// Copy of the profile, other devices can change it at any time
+func (c *Client) ProfileSnapshot() Profile {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.Profile
+}
+
+// The name other players see
+func (c *Client) DisplayName() string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.Profile.DisplayName
+}
+
+// Checks a display name is well formed and not used by any other client
+// Comparison is case insensitive so "Bob" and "bob" can't both exist
+// Registered and identity clients keep their name while they're out of the store
+// Caller must hold s.Mx
+func (s *Store) displayNameTaken(name string, except *Client) bool {
+	for _, c := range s.Clients {
+		if c == except {
+			continue
+		}
+		if strings.EqualFold(c.DisplayName(), name) {
+			return true
+		}
+	}
+	for _, a := range s.Accounts {
+		if a.client == except {
+			continue
+		}
+		if strings.EqualFold(a.client.DisplayName(), name) {
+			return true
+		}
+	}
+	for _, c := range s.Identities {
+		if c == except {
+			continue
+		}
+		if strings.EqualFold(c.DisplayName(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) SetProfile(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "PROFILE" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	if msg.DisplayName != "" && !displayNameRe.MatchString(msg.DisplayName) {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid display name (3-20 letters, digits, _ or -)",
+			Code:    INVALID_NAME,
+		}
+
+		return cErr, nil
+	}
+
+	if msg.Avatar != "" && !avatarRe.MatchString(msg.Avatar) {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid avatar",
+			Code:    INVALID_PROFILE,
+		}
+
+		return cErr, nil
+	}
+
+	if msg.Preferences != nil {
+		switch msg.Preferences.Theme {
+		case "", "light", "dark":
+		default:
+			cErr := &ErrorResultMessage{
+				Kind:    "ERROR",
+				Message: "Invalid theme (light or dark)",
+				Code:    INVALID_PROFILE,
+			}
+
+			return cErr, nil
+		}
+
+		if m := msg.Preferences.RealityCheckMinutes; m < 0 || m > MaxRealityCheckMinutes {
+			cErr := &ErrorResultMessage{
+				Kind:    "ERROR",
+				Message: "Invalid reality check interval (0-240 minutes)",
+				Code:    INVALID_PROFILE,
+			}
+
+			return cErr, nil
+		}
+	}
+
+	// uniqueness check and update under the same lock
+	// otherwise two clients could grab the same name at the same time
+	St.Mx.Lock()
+	if msg.DisplayName != "" && St.displayNameTaken(msg.DisplayName, c) {
+		St.Mx.Unlock()
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Display name already taken",
+			Code:    NAME_TAKEN,
+		}
+
+		return cErr, nil
+	}
+
+	c.mx.Lock()
+	if msg.DisplayName != "" {
+		c.Profile.DisplayName = msg.DisplayName
+	}
+	if msg.Avatar != "" {
+		c.Profile.Avatar = msg.Avatar
+	}
+	if msg.Preferences != nil {
+		c.Profile.Preferences = *msg.Preferences
+	}
+	profile := c.Profile
+	c.mx.Unlock()
+	St.Mx.Unlock()
+
+	err := c.SendMessageContext(ctx, &ProfileResultMessage{
+		Kind:    "PROFILE",
+		Profile: profile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("Profile updated", slog.String("displayName", profile.DisplayName))
+	return nil, nil
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Used when the player didn't pick an interval in their preferences
+var RealityCheckInterval = 30 * time.Minute
+
+const MaxRealityCheckMinutes = 240
+
+type RealityCheckMessage struct {
+	Kind    string `json:"kind"`
+	Elapsed int    `json:"elapsed"` // seconds since STARTPLAY
+	Profit  int    `json:"profit"`
+	Plays   int    `json:"plays"`
+}
+
+type RealityAckResultMessage struct {
+	Kind string `json:"kind"`
+}
+
+// Caller must hold c.mx
+func (c *Client) realityCheckInterval() time.Duration {
+	if m := c.Profile.Preferences.RealityCheckMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return RealityCheckInterval
+}
+
+// Caller must hold c.mx
+func (c *Client) scheduleRealityCheck(s *Session) {
+	s.realityTimer = time.AfterFunc(c.realityCheckInterval(), func() {
+		c.realityCheck(s)
+	})
+}
+
+// Pushes the session summary and holds further plays until it's acknowledged
+func (c *Client) realityCheck(s *Session) {
+	c.mx.Lock()
+	// session ended or was replaced while the timer was running
+	if c.Session != s || !s.Playing {
+		c.mx.Unlock()
+		return
+	}
+
+	s.AwaitingAck = true
+	msg := &RealityCheckMessage{
+		Kind:    "REALITYCHECK",
+		Elapsed: int(time.Since(s.StartedAt).Seconds()),
+		Profit:  s.Profit,
+		Plays:   s.Plays,
+	}
+	c.mx.Unlock()
+
+	err := c.SendMessage(msg)
+	if err != nil {
+		slog.Warn("SendMessage failed", slog.String("clientId", c.Id), slog.Any("error", err))
+	}
+
+	slog.Debug("Reality check", slog.String("clientId", c.Id), slog.Int("elapsed", msg.Elapsed), slog.Int("profit", msg.Profit), slog.Int("plays", msg.Plays))
+}
+
+func (c *Client) AckRealityCheck(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "REALITYACK" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	c.mx.Lock()
+	s := c.Session
+	if s == nil || !s.Playing || !s.AwaitingAck {
+		c.mx.Unlock()
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "No reality check to acknowledge",
+			Code:    NO_REALITY_CHECK,
+		}
+
+		return cErr, nil
+	}
+
+	// next one counts from the acknowledgement, not from the push
+	s.AwaitingAck = false
+	c.scheduleRealityCheck(s)
+	c.mx.Unlock()
+
+	err := c.SendMessageContext(ctx, &RealityAckResultMessage{
+		Kind: "REALITYACK",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
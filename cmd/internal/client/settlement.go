@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Why the server ended a session for the player
+const (
+	SettledExpired      = "EXPIRED"      // the client sent nothing for IdleTimeout, dropped connections included
+	SettledDisconnected = "DISCONNECTED" // an operator disconnected the client, not a connection closing
+	SettledShutdown     = "SHUTDOWN"     // the server is stopping
+)
+
+// Pushed when the server ended the session, right away to the connected
+// devices or to the next one that logs in to the client
+type SettledMessage struct {
+	Kind    string            `json:"kind"`
+	Reason  string            `json:"reason"`
+	Profit  int               `json:"result"` // same as ENDPLAY
+	Wallet  int               `json:"wallet"`
+	History []PlayHistoryItem `json:"history"`
+	EndedAt time.Time         `json:"endedAt"`
+}
+
+// Ends a running session the way ENDPLAY would, the profit or loss goes to
+// the wallet whichever way the round was going
+func (c *Client) settle(ctx context.Context, reason string) {
+	result, history, ok := c.endSession(ctx, "", reason)
+	if !ok {
+		return
+	}
+
+	msg := &SettledMessage{
+		Kind:    "SETTLED",
+		Reason:  reason,
+		Profit:  result.Profit,
+		Wallet:  result.Wallet,
+		History: history,
+		EndedAt: time.Now(),
+	}
+	slog.Info("Session settled", slog.String("clientId", c.Id), slog.String("reason", reason), slog.Int("profit", msg.Profit), slog.Int("wallet", msg.Wallet))
+
+	if c.Online() {
+		err := c.SendMessageContext(ctx, msg)
+		if err == nil {
+			return
+		}
+		slog.Warn("SendMessage failed", slog.String("clientId", c.Id), slog.Any("error", err))
+	}
+
+	// guests can't log back in once they're gone, so keeping it is only worth
+	// it for accounts and identities
+	St.Mx.Lock()
+	registered := c.registered()
+	St.Mx.Unlock()
+	if !registered {
+		return
+	}
+
+	c.mx.Lock()
+	c.settled = msg
+	c.mx.Unlock()
+}
+
+// Sends d the settlement the client hasn't been told about, if any
+func (c *Client) reportSettled(ctx context.Context, d *Device) {
+	c.mx.Lock()
+	msg := c.settled
+	c.settled = nil
+	c.mx.Unlock()
+	if msg == nil {
+		return
+	}
+
+	err := d.SendMessageContext(ctx, msg)
+	if err != nil {
+		d.Log().Warn("SendMessage failed", slog.Any("error", err))
+		// try again on the next login
+		c.mx.Lock()
+		if c.settled == nil {
+			c.settled = msg
+		}
+		c.mx.Unlock()
+	}
+}
+
+// Settles every running session, on shutdown before the connections are
+// closed so the players still get told
+func (s *Store) SettleAll(reason string) {
+	s.Mx.Lock()
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, c := range s.Clients {
+		clients = append(clients, c)
+	}
+	s.Mx.Unlock()
+
+	for _, c := range clients {
+		c.settle(context.Background(), reason)
+	}
+}
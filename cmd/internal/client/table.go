@@ -0,0 +1,527 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"cgoncalveslck/dicegame/cmd/internal/round"
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"context"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const MaxSeats = 8
+
+// Phase timings for every table, var so tests can shorten them
+var TableRounds = round.Config{
+	Betting: 15 * time.Second,
+	Locked:  2 * time.Second,
+	Result:  5 * time.Second,
+	Tick:    time.Second,
+}
+
+var tableIdRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+type TableBet struct {
+	Choice string
+	Bet    int
+	Pays   int // from the rules when the bet was placed
+}
+
+// A table shares one dice roll between everyone that bet on it
+// Stakes leave the wallet when the bet is placed, winners get the stake back
+// plus Pays times it, at the rules' rate for the bet type when it was placed
+// Rounds are driven by a round.Scheduler that runs while anyone is seated
+type Table struct {
+	Id       string
+	Seats    map[string]*Client   // map[clientId]*Client
+	Bets     map[string]*TableBet // map[clientId]*TableBet, current round only
+	Open     bool
+	ClosesAt time.Time
+
+	closed bool // last player left, table was removed from the store
+	sched  *round.Scheduler
+	clock  clock.Clock // the scheduler's, ClosesAt is on it
+	mx     sync.Mutex
+}
+
+type TablePlayer struct {
+	DisplayName string `json:"displayName"`
+	Avatar      string `json:"avatar"`
+}
+
+type JoinTableResultMessage struct {
+	Kind        string        `json:"kind"`
+	Table       string        `json:"table"`
+	Players     []TablePlayer `json:"players"`
+	BettingOpen bool          `json:"bettingOpen"`
+	ClosesIn    int           `json:"closesIn"` // seconds
+}
+
+type LeaveTableResultMessage struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Refund int    `json:"refund"`
+}
+
+type TableBetResultMessage struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Bet    int    `json:"bet"`
+	Choice string `json:"choice"`
+	Wallet int    `json:"wallet"`
+}
+
+type BettingOpenMessage struct {
+	Kind     string `json:"kind"`
+	Table    string `json:"table"`
+	ClosesIn int    `json:"closesIn"` // seconds
+}
+
+type CountdownMessage struct {
+	Kind      string `json:"kind"`
+	Table     string `json:"table"`
+	Phase     string `json:"phase"`
+	Remaining int    `json:"remaining"` // seconds
+}
+
+type BetsLockedMessage struct {
+	Kind  string `json:"kind"`
+	Table string `json:"table"`
+	Bets  int    `json:"bets"`
+}
+
+type TableRollResult struct {
+	DisplayName string `json:"displayName"`
+	Choice      string `json:"choice"`
+	Bet         int    `json:"bet"`
+	Result      string `json:"result"`
+	Payout      int    `json:"payout"`
+}
+
+type TableRollMessage struct {
+	Kind    string            `json:"kind"`
+	Table   string            `json:"table"`
+	Roll    int               `json:"roll"`
+	Results []TableRollResult `json:"results"`
+}
+
+func (c *Client) SeatedAt() *Table {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.Table
+}
+
+func (c *Client) setTable(t *Table) {
+	c.mx.Lock()
+	c.Table = t
+	c.mx.Unlock()
+}
+
+// Sends msg to every seated player, errors are only logged since one
+// broken connection shouldn't stop the others from getting it
+func broadcast(players []*Client, msg interface{}) {
+	broadcastContext(context.Background(), players, msg)
+}
+
+// broadcast for what a message set off, sent under the message's span
+func broadcastContext(ctx context.Context, players []*Client, msg interface{}) {
+	for _, p := range players {
+		err := p.SendMessageContext(ctx, msg)
+		if err != nil {
+			slog.Debug("Broadcast failed", slog.String("clientId", p.Id), slog.Any("error", err))
+		}
+	}
+}
+
+// Caller must hold t.mx
+func (t *Table) players() []*Client {
+	players := make([]*Client, 0, len(t.Seats))
+	for _, p := range t.Seats {
+		players = append(players, p)
+	}
+	return players
+}
+
+// Turns scheduler events into table state and broadcasts
+func (t *Table) onRound(e round.Event) {
+	t.mx.Lock()
+	if t.closed {
+		t.mx.Unlock()
+		return
+	}
+
+	var msgs []interface{}
+	switch {
+	case e.Tick:
+		msgs = append(msgs, &CountdownMessage{
+			Kind:      "COUNTDOWN",
+			Table:     t.Id,
+			Phase:     string(e.Phase),
+			Remaining: int(e.Remaining.Round(time.Second).Seconds()),
+		})
+	case e.Phase == round.Betting:
+		t.Open = true
+		t.ClosesAt = t.clock.Now().Add(e.Remaining)
+		t.Bets = make(map[string]*TableBet)
+		msgs = append(msgs, &BettingOpenMessage{
+			Kind:     "BETTINGOPEN",
+			Table:    t.Id,
+			ClosesIn: int(e.Remaining.Seconds()),
+		})
+	case e.Phase == round.Locked:
+		t.Open = false
+		msgs = append(msgs, &BetsLockedMessage{
+			Kind:  "BETSLOCKED",
+			Table: t.Id,
+			Bets:  len(t.Bets),
+		})
+	case e.Phase == round.Result:
+		msgs = append(msgs, t.settle(e.Roll))
+	}
+
+	players := t.players()
+	t.mx.Unlock()
+
+	for _, msg := range msgs {
+		broadcast(players, msg)
+	}
+}
+
+// Pays the winners of the locked round, caller must hold t.mx
+func (t *Table) settle(num int) *TableRollMessage {
+	rMsg := &TableRollMessage{
+		Kind:    "TABLEROLL",
+		Table:   t.Id,
+		Roll:    num,
+		Results: make([]TableRollResult, 0, len(t.Bets)),
+	}
+
+	for id, b := range t.Bets {
+		p, ok := t.Seats[id]
+		if !ok {
+			continue
+		}
+
+		res := TableRollResult{
+			DisplayName: p.DisplayName(),
+			Choice:      b.Choice,
+			Bet:         b.Bet,
+			Result:      "LOSE",
+		}
+		metrics.Wager(b.Bet)
+		if rules.Wins(b.Choice, num) {
+			res.Result = "WIN"
+			res.Payout = b.Bet * (b.Pays + 1)
+			metrics.Payout(res.Payout)
+			p.Credit(res.Payout, "table_win")
+			p.recordBet(b.Bet, b.Bet*b.Pays)
+		} else {
+			p.recordBet(b.Bet, -b.Bet)
+		}
+		rMsg.Results = append(rMsg.Results, res)
+	}
+	t.Bets = make(map[string]*TableBet)
+
+	slog.Debug("Table settled", slog.String("table", t.Id), slog.Int("roll", num), slog.Int("bets", len(rMsg.Results)))
+	return rMsg
+}
+
+// Removes c from the table refunding any bet that wasn't rolled yet
+// The table is dropped from the store once the last player leaves
+func (t *Table) Leave(c *Client) int {
+	t.mx.Lock()
+	if _, ok := t.Seats[c.Id]; !ok {
+		t.mx.Unlock()
+		return 0
+	}
+
+	// settle empties Bets, anything still here hasn't been rolled, locked or not
+	refund := 0
+	if b, ok := t.Bets[c.Id]; ok {
+		refund = b.Bet
+		delete(t.Bets, c.Id)
+	}
+	delete(t.Seats, c.Id)
+
+	empty := len(t.Seats) == 0
+	if empty {
+		t.closed = true
+		if t.sched != nil {
+			t.sched.Stop()
+		}
+	}
+	t.mx.Unlock()
+
+	c.setTable(nil)
+	if refund > 0 {
+		c.Credit(refund, "table_refund")
+	}
+
+	if empty {
+		St.Mx.Lock()
+		if St.Tables[t.Id] == t {
+			delete(St.Tables, t.Id)
+		}
+		St.Mx.Unlock()
+	}
+
+	slog.Debug("Left table", slog.String("clientId", c.Id), slog.String("table", t.Id), slog.Int("refund", refund))
+	return refund
+}
+
+func (c *Client) JoinTable(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "JOIN" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	if !rules.Current().Features.Tables {
+		return featureDisabled("Tables"), nil
+	}
+
+	id := msg.Table
+	if id == "" {
+		id = "main"
+	}
+
+	if !tableIdRe.MatchString(id) {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid table (1-32 letters, digits, _ or -)",
+			Code:    INVALID_TABLE,
+		}
+
+		return cErr, nil
+	}
+
+	if c.SeatedAt() != nil {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Already seated at a table",
+			Code:    ALREADY_SEATED,
+		}
+
+		return cErr, nil
+	}
+
+	// lock order is always store then table
+	St.Mx.Lock()
+	t, ok := St.Tables[id]
+	if ok {
+		t.mx.Lock()
+		// the last player may have just left, it's on its way out of the store
+		if t.closed {
+			t.mx.Unlock()
+			ok = false
+		}
+	}
+	if !ok {
+		t = &Table{
+			Id:    id,
+			Seats: make(map[string]*Client),
+			Bets:  make(map[string]*TableBet),
+		}
+		St.Tables[id] = t
+		t.mx.Lock()
+	}
+
+	if len(t.Seats) >= MaxSeats {
+		t.mx.Unlock()
+		St.Mx.Unlock()
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Table is full",
+			Code:    TABLE_FULL,
+		}
+
+		return cErr, nil
+	}
+
+	// another device may have seated the client since the check above, only
+	// this one is done under the locks
+	c.mx.Lock()
+	if c.Table != nil {
+		c.mx.Unlock()
+		if len(t.Seats) == 0 {
+			delete(St.Tables, t.Id)
+		}
+		t.mx.Unlock()
+		St.Mx.Unlock()
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Already seated at a table",
+			Code:    ALREADY_SEATED,
+		}
+
+		return cErr, nil
+	}
+	c.Table = t
+	c.mx.Unlock()
+	t.Seats[c.Id] = c
+
+	first := t.sched == nil
+	if first {
+		t.clock = clock.Real{}
+		t.sched = round.New(TableRounds, t.clock, rollDice)
+		t.sched.Subscribe(t.onRound)
+	}
+
+	players := make([]TablePlayer, 0, len(t.Seats))
+	for _, p := range t.Seats {
+		profile := p.ProfileSnapshot()
+		players = append(players, TablePlayer{
+			DisplayName: profile.DisplayName,
+			Avatar:      profile.Avatar,
+		})
+	}
+
+	jMsg := &JoinTableResultMessage{
+		Kind:        "JOIN",
+		Table:       t.Id,
+		Players:     players,
+		BettingOpen: t.Open,
+	}
+	// ClosesAt is from the last betting phase until the next one opens
+	if t.Open {
+		jMsg.ClosesIn = int(max(t.ClosesAt.Sub(t.clock.Now()), 0).Seconds())
+	}
+	t.mx.Unlock()
+	St.Mx.Unlock()
+
+	err := c.SendMessageContext(ctx, jMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// started after the reply so the JOIN always comes before the first BETTINGOPEN
+	if first {
+		go t.sched.Run()
+	}
+
+	logging.FromContext(ctx).Debug("Joined table", slog.String("table", t.Id))
+	return nil, nil
+}
+
+func (c *Client) LeaveTable(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "LEAVE" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	t := c.SeatedAt()
+	if t == nil {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Not seated at a table",
+			Code:    NOT_SEATED,
+		}
+
+		return cErr, nil
+	}
+
+	refund := t.Leave(c)
+
+	err := c.SendMessageContext(ctx, &LeaveTableResultMessage{
+		Kind:   "LEAVE",
+		Table:  t.Id,
+		Refund: refund,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (c *Client) TableBet(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "BET" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	t := c.SeatedAt()
+	if t == nil {
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Not seated at a table",
+			Code:    NOT_SEATED,
+		}
+
+		return cErr, nil
+	}
+
+	r := rules.Current()
+	p, cErr := c.ValidatePlay(msg, r)
+	if cErr != nil {
+		return cErr, nil
+	}
+	bet, _ := r.Bet(p.Choice)
+
+	t.mx.Lock()
+	switch {
+	case !t.Open:
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Betting is closed",
+			Code:    BETTING_CLOSED,
+		}
+	case t.Bets[c.Id] != nil:
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Already bet this round",
+			Code:    ALREADY_BET,
+		}
+	// escrow the stake while holding the table lock so the roll can't
+	// happen between taking the money and recording the bet
+	case !c.Debit(p.Bet, "table_bet"):
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Insufficient points",
+			Code:    NO_BALANCE,
+		}
+	default:
+		t.Bets[c.Id] = &TableBet{
+			Choice: p.Choice,
+			Bet:    p.Bet,
+			Pays:   bet.Pays,
+		}
+	}
+	t.mx.Unlock()
+
+	if cErr != nil {
+		return cErr, nil
+	}
+
+	err := c.SendMessageContext(ctx, &TableBetResultMessage{
+		Kind:   "BET",
+		Table:  t.Id,
+		Bet:    p.Bet,
+		Choice: p.Choice,
+		Wallet: c.Balance(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("Table bet", slog.String("table", t.Id), slog.Int("bet", p.Bet), slog.String("choice", p.Choice))
+	return nil, nil
+}
@@ -0,0 +1,607 @@
+package client
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TournamentRegistering = "REGISTERING"
+	TournamentRunning     = "RUNNING"
+	TournamentFinished    = "FINISHED"
+)
+
+type TournamentConfig struct {
+	BuyIn        int           // taken from the wallet on registration, all of it goes to the prize pool
+	Chips        int           // tournament-only stack every player starts with
+	Registration time.Duration // how long registration is open before the start
+	Duration     time.Duration // 0 means no time limit
+	MaxRolls     int           // per player, 0 means no limit
+	MinPlayers   int           // fewer than this at the start cancels and refunds
+	Prizes       []int         // percentage of the pool for 1st, 2nd, ...
+	Repeat       bool          // schedule the next one when this one is over
+}
+
+var DefaultTournament = TournamentConfig{
+	BuyIn:        10,
+	Chips:        1000,
+	Registration: 5 * time.Minute,
+	Duration:     10 * time.Minute,
+	MaxRolls:     50,
+	MinPlayers:   2,
+	Prizes:       []int{50, 30, 20},
+	Repeat:       true,
+}
+
+type TournamentEntry struct {
+	Client *Client
+	Chips  int
+	Rolls  int
+	joined int // registration order, breaks ties
+}
+
+type Tournament struct {
+	Id       string
+	Config   TournamentConfig
+	State    string
+	StartsAt time.Time
+	EndsAt   time.Time // zero without a time limit
+	Pool     int
+	Entries  map[string]*TournamentEntry // map[clientId]*TournamentEntry
+
+	timer *time.Timer
+	mx    sync.Mutex
+}
+
+type TournamentInfo struct {
+	Id       string `json:"id"`
+	State    string `json:"state"`
+	BuyIn    int    `json:"buyIn"`
+	Chips    int    `json:"chips"`
+	MaxRolls int    `json:"maxRolls"`
+	StartsIn int    `json:"startsIn"` // seconds, 0 once running
+	EndsIn   int    `json:"endsIn"`   // seconds, 0 without a time limit
+	Players  int    `json:"players"`
+	Pool     int    `json:"pool"`
+}
+
+type TournamentsResultMessage struct {
+	Kind        string           `json:"kind"`
+	Tournaments []TournamentInfo `json:"tournaments"`
+}
+
+type TournamentRegisterResultMessage struct {
+	Kind       string         `json:"kind"`
+	Tournament TournamentInfo `json:"tournament"`
+	Wallet     int            `json:"wallet"`
+}
+
+type TournamentStartMessage struct {
+	Kind       string         `json:"kind"`
+	Tournament TournamentInfo `json:"tournament"`
+}
+
+type TournamentPlayResultMessage struct {
+	Kind       string `json:"kind"`
+	Tournament string `json:"tournament"`
+	Result     string `json:"result"`
+	Roll       int    `json:"roll"`
+	Chips      int    `json:"chips"`
+	RollsLeft  int    `json:"rollsLeft"` // -1 without a roll limit
+}
+
+type Standing struct {
+	Rank        int    `json:"rank"`
+	DisplayName string `json:"displayName"`
+	Chips       int    `json:"chips"`
+	Rolls       int    `json:"rolls"`
+	Prize       int    `json:"prize"`
+}
+
+type StandingsMessage struct {
+	Kind       string     `json:"kind"`
+	Tournament string     `json:"tournament"`
+	State      string     `json:"state"`
+	Standings  []Standing `json:"standings"`
+}
+
+// Adds a tournament that opens for registration now and starts after cfg.Registration
+func ScheduleTournament(cfg TournamentConfig) (*Tournament, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tournament{
+		Id:       uuid.NewString(),
+		Config:   cfg,
+		State:    TournamentRegistering,
+		StartsAt: time.Now().Add(cfg.Registration),
+		Entries:  make(map[string]*TournamentEntry),
+	}
+
+	St.Mx.Lock()
+	St.Tournaments[t.Id] = t
+	St.Mx.Unlock()
+
+	t.mx.Lock()
+	t.timer = time.AfterFunc(cfg.Registration, t.start)
+	t.mx.Unlock()
+
+	slog.Debug("Tournament scheduled", slog.String("tournament", t.Id), slog.Time("startsAt", t.StartsAt))
+	return t, nil
+}
+
+// A tournament has to start with chips, end on its own and pay out the whole
+// pool, no more and no less
+func (cfg TournamentConfig) Validate() error {
+	if cfg.Chips <= 0 {
+		return fmt.Errorf("tournament chips must be positive, got %d", cfg.Chips)
+	}
+	if cfg.BuyIn < 0 {
+		return fmt.Errorf("tournament buy-in can't be negative, got %d", cfg.BuyIn)
+	}
+	if cfg.Registration <= 0 {
+		return fmt.Errorf("tournament registration must be positive, got %s", cfg.Registration)
+	}
+	if cfg.Duration < 0 || cfg.MaxRolls < 0 {
+		return errors.New("tournament duration and roll limit can't be negative")
+	}
+	// otherwise it only ends once every player is out of chips
+	if cfg.Duration == 0 && cfg.MaxRolls == 0 {
+		return errors.New("tournament needs a duration or a roll limit")
+	}
+	if len(cfg.Prizes) == 0 {
+		return errors.New("tournament needs at least one prize")
+	}
+	total := 0
+	for _, p := range cfg.Prizes {
+		if p < 0 {
+			return fmt.Errorf("tournament prizes can't be negative, got %d", p)
+		}
+		total += p
+	}
+	if total != 100 {
+		return fmt.Errorf("tournament prizes must add up to 100, got %d", total)
+	}
+	return nil
+}
+
+// Caller must hold t.mx
+func (t *Tournament) info() TournamentInfo {
+	info := TournamentInfo{
+		Id:       t.Id,
+		State:    t.State,
+		BuyIn:    t.Config.BuyIn,
+		Chips:    t.Config.Chips,
+		MaxRolls: t.Config.MaxRolls,
+		Players:  len(t.Entries),
+		Pool:     t.Pool,
+	}
+	if t.State == TournamentRegistering {
+		info.StartsIn = int(time.Until(t.StartsAt).Seconds())
+	}
+	if !t.EndsAt.IsZero() {
+		info.EndsIn = int(time.Until(t.EndsAt).Seconds())
+	}
+	return info
+}
+
+// Caller must hold t.mx
+func (t *Tournament) entrants() []*Client {
+	clients := make([]*Client, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		clients = append(clients, e.Client)
+	}
+	return clients
+}
+
+// Ranks by chips, ties go to whoever registered first
+// Caller must hold t.mx
+func (t *Tournament) ranked() []*TournamentEntry {
+	entries := make([]*TournamentEntry, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Chips != entries[j].Chips {
+			return entries[i].Chips > entries[j].Chips
+		}
+		return entries[i].joined < entries[j].joined
+	})
+	return entries
+}
+
+// Caller must hold t.mx
+func (t *Tournament) standings() []Standing {
+	entries := t.ranked()
+	standings := make([]Standing, len(entries))
+	for i, e := range entries {
+		standings[i] = Standing{
+			Rank:        i + 1,
+			DisplayName: e.Client.DisplayName(),
+			Chips:       e.Chips,
+			Rolls:       e.Rolls,
+		}
+	}
+	return standings
+}
+
+func (t *Tournament) remove() {
+	St.Mx.Lock()
+	delete(St.Tournaments, t.Id)
+	St.Mx.Unlock()
+
+	if t.Config.Repeat {
+		ScheduleTournament(t.Config)
+	}
+}
+
+func (t *Tournament) start() {
+	t.mx.Lock()
+	if t.State != TournamentRegistering {
+		t.mx.Unlock()
+		return
+	}
+
+	clients := t.entrants()
+	if len(t.Entries) < t.Config.MinPlayers {
+		t.State = TournamentFinished
+		for _, e := range t.Entries {
+			e.Client.Credit(t.Config.BuyIn, "tournament_refund")
+			e.Client.recordBet(-t.Config.BuyIn, t.Config.BuyIn)
+		}
+		msg := &StandingsMessage{
+			Kind:       "TOURNAMENTCANCELLED",
+			Tournament: t.Id,
+			State:      t.State,
+			Standings:  []Standing{},
+		}
+		t.mx.Unlock()
+
+		broadcast(clients, msg)
+		t.remove()
+		slog.Debug("Tournament cancelled, not enough players", slog.String("tournament", t.Id), slog.Int("players", len(clients)))
+		return
+	}
+
+	t.State = TournamentRunning
+	if t.Config.Duration > 0 {
+		t.EndsAt = time.Now().Add(t.Config.Duration)
+		t.timer = time.AfterFunc(t.Config.Duration, t.end)
+	}
+	msg := &TournamentStartMessage{
+		Kind:       "TOURNAMENTSTART",
+		Tournament: t.info(),
+	}
+	t.mx.Unlock()
+
+	broadcast(clients, msg)
+	slog.Debug("Tournament started", slog.String("tournament", t.Id), slog.Int("players", len(clients)))
+}
+
+// Ranks everyone and pays the prize table out of the pool
+// Places nobody took are shared between the ones that were in proportion to
+// their prizes. What rounding leaves over goes to 1st, and so does the whole
+// pool when the places taken pay nothing
+func (t *Tournament) end() {
+	t.mx.Lock()
+	if t.State != TournamentRunning {
+		t.mx.Unlock()
+		return
+	}
+	t.State = TournamentFinished
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	entries := t.ranked()
+	standings := t.standings()
+	// with fewer players than prizes the places nobody took are shared
+	// between the ones that were, in the same proportions
+	places := min(len(standings), len(t.Config.Prizes))
+	shares := 0
+	for _, p := range t.Config.Prizes[:places] {
+		shares += p
+	}
+	paid := 0
+	for i := 0; i < places && shares > 0; i++ {
+		standings[i].Prize = t.Pool * t.Config.Prizes[i] / shares
+		paid += standings[i].Prize
+	}
+	// rounding, or nothing at all for the places that were taken
+	if len(standings) > 0 {
+		standings[0].Prize += t.Pool - paid
+	}
+
+	for i, e := range entries {
+		if standings[i].Prize > 0 {
+			e.Client.Credit(standings[i].Prize, "tournament_prize")
+			e.Client.recordBet(0, standings[i].Prize)
+		}
+	}
+
+	clients := t.entrants()
+	msg := &StandingsMessage{
+		Kind:       "TOURNAMENTEND",
+		Tournament: t.Id,
+		State:      t.State,
+		Standings:  standings,
+	}
+	t.mx.Unlock()
+
+	broadcast(clients, msg)
+	t.remove()
+	slog.Debug("Tournament ended", slog.String("tournament", t.Id), slog.Int("players", len(clients)))
+}
+
+func findTournament(id string) *Tournament {
+	St.Mx.Lock()
+	defer St.Mx.Unlock()
+	return St.Tournaments[id]
+}
+
+func tournamentNotFound() *ErrorResultMessage {
+	return &ErrorResultMessage{
+		Kind:    "ERROR",
+		Message: "Tournament not found",
+		Code:    TOURNAMENT_NOT_FOUND,
+	}
+}
+
+func (c *Client) ListTournaments(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "TOURNAMENTS" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	St.Mx.Lock()
+	tournaments := make([]*Tournament, 0, len(St.Tournaments))
+	for _, t := range St.Tournaments {
+		tournaments = append(tournaments, t)
+	}
+	St.Mx.Unlock()
+
+	infos := make([]TournamentInfo, 0, len(tournaments))
+	for _, t := range tournaments {
+		t.mx.Lock()
+		infos = append(infos, t.info())
+		t.mx.Unlock()
+	}
+
+	err := c.SendMessageContext(ctx, &TournamentsResultMessage{
+		Kind:        "TOURNAMENTS",
+		Tournaments: infos,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (c *Client) RegisterTournament(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "TREGISTER" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	if !rules.Current().Features.Tournaments {
+		return featureDisabled("Tournaments"), nil
+	}
+
+	t := findTournament(msg.Tournament)
+	if t == nil {
+		return tournamentNotFound(), nil
+	}
+
+	cErr := c.checkLimits(t.Config.BuyIn)
+	if cErr != nil {
+		return cErr, nil
+	}
+
+	t.mx.Lock()
+	switch {
+	case t.State != TournamentRegistering:
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Registration is closed",
+			Code:    TOURNAMENT_CLOSED,
+		}
+	case t.Entries[c.Id] != nil:
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Already registered",
+			Code:    ALREADY_REGISTERED,
+		}
+	case !c.Debit(t.Config.BuyIn, "tournament_buyin"):
+		cErr = &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Insufficient points",
+			Code:    NO_BALANCE,
+		}
+	default:
+		c.recordBet(t.Config.BuyIn, -t.Config.BuyIn)
+		t.Pool += t.Config.BuyIn
+		t.Entries[c.Id] = &TournamentEntry{
+			Client: c,
+			Chips:  t.Config.Chips,
+			joined: len(t.Entries),
+		}
+	}
+	info := t.info()
+	t.mx.Unlock()
+
+	if cErr != nil {
+		return cErr, nil
+	}
+
+	err := c.SendMessageContext(ctx, &TournamentRegisterResultMessage{
+		Kind:       "TREGISTER",
+		Tournament: info,
+		Wallet:     c.Balance(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("Tournament registration", slog.String("tournament", t.Id))
+	return nil, nil
+}
+
+// Same game as Play, with the current rules' bet types, but with tournament
+// chips instead of the wallet
+func (c *Client) PlayTournament(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "TPLAY" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	t := findTournament(msg.Tournament)
+	if t == nil {
+		return tournamentNotFound(), nil
+	}
+
+	r := rules.Current()
+	bet, enabled := r.Bet(msg.Choice)
+
+	t.mx.Lock()
+	e := t.Entries[c.Id]
+
+	var eMessage string
+	var code cError
+	switch {
+	case e == nil:
+		eMessage = "Not registered"
+		code = NOT_REGISTERED
+	case t.State != TournamentRunning:
+		eMessage = "Tournament isn't running"
+		code = TOURNAMENT_CLOSED
+	case t.Config.MaxRolls > 0 && e.Rolls >= t.Config.MaxRolls:
+		eMessage = "No rolls left"
+		code = NO_ROLLS_LEFT
+	case msg.Bet > e.Chips:
+		eMessage = "Insufficient chips"
+		code = NO_BALANCE
+	case msg.Bet < 1:
+		eMessage = "Invalid bet"
+		code = INVALID_BET
+	case !enabled:
+		eMessage = "Invalid choice (" + strings.Join(r.Choices(), " or ") + ")"
+		code = INVALID_CHOICE
+	}
+
+	if code != 0 {
+		t.mx.Unlock()
+		cErr := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: eMessage,
+			Code:    code,
+		}
+
+		return cErr, nil
+	}
+
+	num := rollDice()
+	res := "LOSE"
+	if rules.Wins(msg.Choice, num) {
+		e.Chips += msg.Bet * bet.Pays
+		res = "WIN"
+	} else {
+		e.Chips -= msg.Bet
+	}
+	e.Rolls++
+
+	rollsLeft := -1
+	if t.Config.MaxRolls > 0 {
+		rollsLeft = t.Config.MaxRolls - e.Rolls
+	}
+
+	// over early once nobody can play anymore
+	done := true
+	for _, e := range t.Entries {
+		if e.Chips > 0 && (t.Config.MaxRolls == 0 || e.Rolls < t.Config.MaxRolls) {
+			done = false
+			break
+		}
+	}
+
+	rMsg := &TournamentPlayResultMessage{
+		Kind:       "TROLL",
+		Tournament: t.Id,
+		Result:     res,
+		Roll:       num,
+		Chips:      e.Chips,
+		RollsLeft:  rollsLeft,
+	}
+	t.mx.Unlock()
+
+	err := c.SendMessageContext(ctx, rMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	if done {
+		t.end()
+	}
+
+	return nil, nil
+}
+
+func (c *Client) TournamentStandings(ctx context.Context, msg *DefaultMessage) (*ErrorResultMessage, error) {
+	if msg.Kind != "TSTANDINGS" || msg.ClientId == "" {
+		cError := &ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "Invalid message",
+			Code:    INVALID_JASON,
+		}
+
+		return cError, nil
+	}
+
+	t := findTournament(msg.Tournament)
+	if t == nil {
+		return tournamentNotFound(), nil
+	}
+
+	t.mx.Lock()
+	sMsg := &StandingsMessage{
+		Kind:       "TSTANDINGS",
+		Tournament: t.Id,
+		State:      t.State,
+		Standings:  t.standings(),
+	}
+	t.mx.Unlock()
+
+	err := c.SendMessageContext(ctx, sMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
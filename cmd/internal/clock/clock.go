@@ -0,0 +1,91 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the bit of the time package the game loops need
+// Lets tests drive timers by hand instead of sleeping
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Fake only moves when Advance is called
+type Fake struct {
+	now     time.Time
+	waiters []waiter
+	mx      sync.Mutex
+	cond    *sync.Cond
+}
+
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mx)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+
+	f.waiters = append(f.waiters, waiter{at: f.now.Add(d), ch: ch})
+	f.cond.Broadcast()
+	return ch
+}
+
+// Moves the clock forward firing every waiter that's due
+func (f *Fake) Advance(d time.Duration) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.now = f.now.Add(d)
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if !w.at.After(f.now) {
+			w.ch <- f.now
+			continue
+		}
+		pending = append(pending, w)
+	}
+	f.waiters = pending
+}
+
+// Blocks until at least n goroutines are waiting on After
+// Use it before Advance so the code under test has caught up
+func (f *Fake) BlockUntil(n int) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
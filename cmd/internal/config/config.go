@@ -0,0 +1,537 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Everything the server can be told at startup
+// Loaded from defaults, then the JSON file, then environment variables, then
+// flags, each one overriding the ones before
+type Config struct {
+	Listen     string        `json:"listen"`
+	TLS        TLS           `json:"tls"`
+	DrainDelay time.Duration `json:"drainDelay"` // how long /readyz fails before connections are closed on shutdown
+
+	PingInterval    time.Duration `json:"pingInterval"` // how often connections are pinged
+	PongTimeout     time.Duration `json:"pongTimeout"`  // connections silent for longer, pongs included, are closed
+	IdleTimeout     time.Duration `json:"idleTimeout"`  // clients that send no messages for longer are removed from the store
+	IdleWarning     time.Duration `json:"idleWarning"`  // how long before that they're warned
+	StartingBalance int           `json:"startingBalance"`
+	HistorySize     int           `json:"historySize"`
+	AllowGuests     bool          `json:"allowGuests"`
+	Rules           Rules         `json:"rules"`
+
+	AllowedOrigins       []string      `json:"allowedOrigins"`      // browser origins allowed to open sockets, "*" allows any
+	MaxConnections       int           `json:"maxConnections"`      // 0 means no limit
+	MaxConnectionsPerIP  int           `json:"maxConnectionsPerIp"` // 0 means no limit
+	MaxMessageSize       int           `json:"maxMessageSize"`      // bytes, bigger frames close the connection
+	MaxDevices           int           `json:"maxDevices"`          // connections one client can have at once, 0 means no limit
+	RateLimit            RateLimit     `json:"rateLimit"`
+	Tables               Tables        `json:"tables"`
+	Jackpot              Jackpot       `json:"jackpot"`
+	RealityCheckInterval time.Duration `json:"realityCheckInterval"` // for players who didn't pick their own
+
+	Log        Log    `json:"log"`
+	Audit      Audit  `json:"audit"`
+	AdminToken string `json:"adminToken"`
+	OIDC       OIDC   `json:"oidc"`
+	Traces     string `json:"traces"` // "", "none", "stdout" or "otlp"
+}
+
+type TLS struct {
+	CertFile       string        `json:"certFile"`
+	KeyFile        string        `json:"keyFile"`
+	ReloadInterval time.Duration `json:"reloadInterval"` // how often the files are checked for a new certificate
+	AdminClientCA  string        `json:"adminClientCa"`  // CA for admin client certificates, mTLS on /admin/ when set
+}
+
+type Rules struct {
+	File           string        `json:"file"`           // game rules, the defaults when unset
+	ReloadInterval time.Duration `json:"reloadInterval"` // how often the file is checked for changes, SIGHUP reloads it at once
+}
+
+// Token buckets by message kind, "*" covers every kind without its own
+// Kinds left out keep their default
+type RateRules map[string]RateRule
+
+type RateRule struct {
+	Rate  float64 `json:"rate"` // tokens per second
+	Burst int     `json:"burst"`
+}
+
+type RateLimit struct {
+	PerConn         RateRules     `json:"perConn"`
+	PerClient       RateRules     `json:"perClient"`
+	PerIP           RateRules     `json:"perIp"`
+	MaxViolations   int           `json:"maxViolations"` // limited more often than this within ViolationWindow closes the connection, 0 never does
+	ViolationWindow time.Duration `json:"violationWindow"`
+}
+
+// Phase timings every table runs with
+type Tables struct {
+	Betting time.Duration `json:"betting"`
+	Locked  time.Duration `json:"locked"`
+	Result  time.Duration `json:"result"`
+	Tick    time.Duration `json:"tick"` // countdown interval, 0 disables ticks
+}
+
+type Jackpot struct {
+	Percent int `json:"percent"` // of every PLAY stake
+	Seed    int `json:"seed"`    // what the pool starts and restarts at
+}
+
+type Log struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	Sample int    `json:"sample"`
+}
+
+type Audit struct {
+	File string `json:"file"`
+	Key  string `json:"key"`
+}
+
+type OIDC struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectUrl"`
+	Scopes       []string `json:"scopes"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen:          ":8181",
+		TLS:             TLS{ReloadInterval: 10 * time.Second},
+		DrainDelay:      5 * time.Second,
+		PingInterval:    30 * time.Second,
+		PongTimeout:     60 * time.Second,
+		IdleTimeout:     5 * time.Minute,
+		IdleWarning:     30 * time.Second,
+		StartingBalance: 100,
+		HistorySize:     10,
+		AllowGuests:     true,
+		Rules:           Rules{ReloadInterval: 10 * time.Second},
+		AllowedOrigins: []string{
+			"http://localhost:3000",
+			"https://dicegame-rho-seven.vercel.app",
+		},
+		MaxConnections:      10000,
+		MaxConnectionsPerIP: 20,
+		MaxMessageSize:      4096,
+		MaxDevices:          5,
+		RateLimit: RateLimit{
+			PerConn: RateRules{
+				"*":        {Rate: 10, Burst: 30},
+				"PLAY":     {Rate: 5, Burst: 15},
+				"WALLET":   {Rate: 2, Burst: 10},
+				"LOGIN":    {Rate: 0.2, Burst: 5},
+				"REGISTER": {Rate: 0.2, Burst: 5},
+			},
+			PerClient: RateRules{
+				"*": {Rate: 20, Burst: 60},
+			},
+			PerIP: RateRules{
+				"*":        {Rate: 100, Burst: 300},
+				"LOGIN":    {Rate: 1, Burst: 20},
+				"REGISTER": {Rate: 1, Burst: 20},
+			},
+			MaxViolations:   20,
+			ViolationWindow: 10 * time.Second,
+		},
+		Tables:               Tables{Betting: 15 * time.Second, Locked: 2 * time.Second, Result: 5 * time.Second, Tick: time.Second},
+		Jackpot:              Jackpot{Percent: 1, Seed: 100},
+		RealityCheckInterval: 30 * time.Minute,
+		Log:                  Log{Level: "info", Format: "text", Sample: 100},
+		Audit:                Audit{File: "audit.jsonl"},
+	}
+}
+
+// One setting, reachable as ENV and -flag
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  func(c *Config) interface{} // pointer to the field
+}
+
+var settings = []setting{
+	{"LISTEN_ADDR", "listen", "address to listen on", false, func(c *Config) interface{} { return &c.Listen }},
+	{"TLS_CERT_FILE", "tls-cert", "TLS certificate, serves plain HTTP when unset", false, func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{"TLS_KEY_FILE", "tls-key", "TLS private key", false, func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{"TLS_RELOAD_INTERVAL", "tls-reload-interval", "how often the certificate files are checked for changes", false, func(c *Config) interface{} { return &c.TLS.ReloadInterval }},
+	{"ADMIN_CLIENT_CA", "admin-client-ca", "CA bundle admin client certificates must be signed by, requires TLS", false, func(c *Config) interface{} { return &c.TLS.AdminClientCA }},
+	{"DRAIN_DELAY", "drain-delay", "how long /readyz fails before closing connections on shutdown", false, func(c *Config) interface{} { return &c.DrainDelay }},
+	{"PING_INTERVAL", "ping-interval", "how often connections are pinged", false, func(c *Config) interface{} { return &c.PingInterval }},
+	{"PONG_TIMEOUT", "pong-timeout", "connections silent for this long, pongs included, are closed", false, func(c *Config) interface{} { return &c.PongTimeout }},
+	{"IDLE_TIMEOUT", "idle-timeout", "clients that send no messages for this long are removed", false, func(c *Config) interface{} { return &c.IdleTimeout }},
+	{"IDLE_WARNING", "idle-warning", "how long before the idle timeout clients are warned, 0 to not warn", false, func(c *Config) interface{} { return &c.IdleWarning }},
+	{"STARTING_BALANCE", "starting-balance", "wallet of a new client", false, func(c *Config) interface{} { return &c.StartingBalance }},
+	{"HISTORY_SIZE", "history-size", "plays kept in a session's history", false, func(c *Config) interface{} { return &c.HistorySize }},
+	{"ALLOW_GUESTS", "allow-guests", "let clients play without an account", false, func(c *Config) interface{} { return &c.AllowGuests }},
+	{"RULES_FILE", "rules-file", "JSON game rules, reloaded on change or SIGHUP", false, func(c *Config) interface{} { return &c.Rules.File }},
+	{"RULES_RELOAD_INTERVAL", "rules-reload-interval", "how often the rules file is checked for changes", false, func(c *Config) interface{} { return &c.Rules.ReloadInterval }},
+	{"ALLOWED_ORIGINS", "allowed-origins", "browser origins allowed to open sockets, space separated, * allows any", false, func(c *Config) interface{} { return &c.AllowedOrigins }},
+	{"MAX_CONNECTIONS", "max-connections", "open sockets the server accepts, 0 for no limit", false, func(c *Config) interface{} { return &c.MaxConnections }},
+	{"MAX_CONNECTIONS_PER_IP", "max-connections-per-ip", "open sockets one address can have, 0 for no limit", false, func(c *Config) interface{} { return &c.MaxConnectionsPerIP }},
+	{"MAX_MESSAGE_SIZE", "max-message-size", "biggest message in bytes, bigger ones close the connection", false, func(c *Config) interface{} { return &c.MaxMessageSize }},
+	{"MAX_DEVICES", "max-devices", "connections one client can have at once, 0 for no limit", false, func(c *Config) interface{} { return &c.MaxDevices }},
+	{"RATE_LIMIT_CONN", "rate-limit-conn", "per connection limits as KIND=rate/burst, space separated", false, func(c *Config) interface{} { return &c.RateLimit.PerConn }},
+	{"RATE_LIMIT_CLIENT", "rate-limit-client", "per client limits as KIND=rate/burst, space separated", false, func(c *Config) interface{} { return &c.RateLimit.PerClient }},
+	{"RATE_LIMIT_IP", "rate-limit-ip", "per address limits as KIND=rate/burst, space separated", false, func(c *Config) interface{} { return &c.RateLimit.PerIP }},
+	{"RATE_LIMIT_MAX_VIOLATIONS", "rate-limit-max-violations", "connections limited more often than this within the window are closed, 0 never closes them", false, func(c *Config) interface{} { return &c.RateLimit.MaxViolations }},
+	{"RATE_LIMIT_VIOLATION_WINDOW", "rate-limit-violation-window", "window for rate-limit-max-violations", false, func(c *Config) interface{} { return &c.RateLimit.ViolationWindow }},
+	{"TABLE_BETTING", "table-betting", "how long tables take bets each round", false, func(c *Config) interface{} { return &c.Tables.Betting }},
+	{"TABLE_LOCKED", "table-locked", "how long bets are locked before the roll", false, func(c *Config) interface{} { return &c.Tables.Locked }},
+	{"TABLE_RESULT", "table-result", "how long the result shows before the next round", false, func(c *Config) interface{} { return &c.Tables.Result }},
+	{"TABLE_TICK", "table-tick", "countdown interval, 0 disables ticks", false, func(c *Config) interface{} { return &c.Tables.Tick }},
+	{"JACKPOT_PERCENT", "jackpot-percent", "percentage of every PLAY stake that feeds the jackpot", false, func(c *Config) interface{} { return &c.Jackpot.Percent }},
+	{"JACKPOT_SEED", "jackpot-seed", "what the jackpot starts and restarts at", false, func(c *Config) interface{} { return &c.Jackpot.Seed }},
+	{"REALITY_CHECK_INTERVAL", "reality-check-interval", "reality check interval for players who didn't pick their own", false, func(c *Config) interface{} { return &c.RealityCheckInterval }},
+	{"LOG_LEVEL", "log-level", "debug, info, warn or error", false, func(c *Config) interface{} { return &c.Log.Level }},
+	{"LOG_FORMAT", "log-format", "text or json", false, func(c *Config) interface{} { return &c.Log.Format }},
+	{"LOG_SAMPLE", "log-sample", "keep 1 in this many per-message debug lines", false, func(c *Config) interface{} { return &c.Log.Sample }},
+	{"AUDIT_FILE", "audit-file", "audit log path", false, func(c *Config) interface{} { return &c.Audit.File }},
+	{"AUDIT_KEY", "audit-key", "HMAC key for the audit log", true, func(c *Config) interface{} { return &c.Audit.Key }},
+	{"ADMIN_TOKEN", "admin-token", "bearer token for /admin/, the admin API is off when unset", true, func(c *Config) interface{} { return &c.AdminToken }},
+	{"OIDC_ISSUER", "oidc-issuer", "OpenID Connect issuer URL", false, func(c *Config) interface{} { return &c.OIDC.Issuer }},
+	{"OIDC_CLIENT_ID", "oidc-client-id", "OpenID Connect client id", false, func(c *Config) interface{} { return &c.OIDC.ClientID }},
+	{"OIDC_CLIENT_SECRET", "oidc-client-secret", "OpenID Connect client secret", true, func(c *Config) interface{} { return &c.OIDC.ClientSecret }},
+	{"OIDC_REDIRECT_URL", "oidc-redirect-url", "OpenID Connect redirect URL", false, func(c *Config) interface{} { return &c.OIDC.RedirectURL }},
+	{"OIDC_SCOPES", "oidc-scopes", "extra OpenID Connect scopes, space separated", false, func(c *Config) interface{} { return &c.OIDC.Scopes }},
+	{"OTEL_TRACES_EXPORTER", "traces", "none, stdout or otlp", false, func(c *Config) interface{} { return &c.Traces }},
+}
+
+func set(field interface{}, v string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = v
+	case *[]string:
+		*f = strings.Fields(v)
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*f = b
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*f = d
+	case *RateRules:
+		return f.set(v)
+	default:
+		panic(fmt.Sprintf("config: no setter for %T", field))
+	}
+	return nil
+}
+
+func format(field interface{}) string {
+	switch f := field.(type) {
+	case *string:
+		return *f
+	case *[]string:
+		return strings.Join(*f, " ")
+	case *int:
+		return strconv.Itoa(*f)
+	case *bool:
+		return strconv.FormatBool(*f)
+	case *time.Duration:
+		return f.String()
+	case *RateRules:
+		return f.String()
+	}
+	panic(fmt.Sprintf("config: no formatter for %T", field))
+}
+
+// Builds the configuration from args (os.Args[1:]) and getenv
+// The file is -config, or CONFIG_FILE when the flag isn't given
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("dicegame", flag.ContinueOnError)
+	file := fs.String("config", "", "JSON configuration file")
+	flags := map[string]*string{}
+	for _, s := range settings {
+		flags[s.flag] = fs.String(s.flag, "", s.usage+" ($"+s.env+")")
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Default()
+
+	path := *file
+	if path == "" {
+		path = getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		err := c.loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		v := getenv(s.env)
+		if v == "" {
+			continue
+		}
+		err := set(s.value(c), v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && flagErr == nil {
+				err := set(s.value(c), *flags[s.flag])
+				if err != nil {
+					flagErr = fmt.Errorf("-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Durations are strings like "5m" in the file, the rest is plain JSON
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	type alias Config
+	type tlsAlias TLS
+	type tlsFile struct {
+		*tlsAlias
+		ReloadInterval *duration `json:"reloadInterval"`
+	}
+	type rulesAlias Rules
+	type rulesFile struct {
+		*rulesAlias
+		ReloadInterval *duration `json:"reloadInterval"`
+	}
+	type rateLimitAlias RateLimit
+	type rateLimitFile struct {
+		*rateLimitAlias
+		ViolationWindow *duration `json:"violationWindow"`
+	}
+	type tablesFile struct {
+		Betting *duration `json:"betting"`
+		Locked  *duration `json:"locked"`
+		Result  *duration `json:"result"`
+		Tick    *duration `json:"tick"`
+	}
+	file := struct {
+		*alias
+		TLS                  tlsFile       `json:"tls"`
+		Rules                rulesFile     `json:"rules"`
+		RateLimit            rateLimitFile `json:"rateLimit"`
+		Tables               tablesFile    `json:"tables"`
+		DrainDelay           *duration     `json:"drainDelay"`
+		PingInterval         *duration     `json:"pingInterval"`
+		PongTimeout          *duration     `json:"pongTimeout"`
+		IdleTimeout          *duration     `json:"idleTimeout"`
+		IdleWarning          *duration     `json:"idleWarning"`
+		RealityCheckInterval *duration     `json:"realityCheckInterval"`
+	}{
+		alias: (*alias)(c),
+		TLS: tlsFile{
+			tlsAlias:       (*tlsAlias)(&c.TLS),
+			ReloadInterval: (*duration)(&c.TLS.ReloadInterval),
+		},
+		Rules: rulesFile{
+			rulesAlias:     (*rulesAlias)(&c.Rules),
+			ReloadInterval: (*duration)(&c.Rules.ReloadInterval),
+		},
+		RateLimit: rateLimitFile{
+			rateLimitAlias:  (*rateLimitAlias)(&c.RateLimit),
+			ViolationWindow: (*duration)(&c.RateLimit.ViolationWindow),
+		},
+		Tables: tablesFile{
+			Betting: (*duration)(&c.Tables.Betting),
+			Locked:  (*duration)(&c.Tables.Locked),
+			Result:  (*duration)(&c.Tables.Result),
+			Tick:    (*duration)(&c.Tables.Tick),
+		},
+		DrainDelay:           (*duration)(&c.DrainDelay),
+		PingInterval:         (*duration)(&c.PingInterval),
+		PongTimeout:          (*duration)(&c.PongTimeout),
+		IdleTimeout:          (*duration)(&c.IdleTimeout),
+		IdleWarning:          (*duration)(&c.IdleWarning),
+		RealityCheckInterval: (*duration)(&c.RealityCheckInterval),
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Parses "PLAY=5/15 *=10/30" into r, kinds it doesn't name are kept
+func (r *RateRules) set(v string) error {
+	rules := RateRules{}
+	for k, rule := range *r {
+		rules[k] = rule
+	}
+	for _, field := range strings.Fields(v) {
+		kind, limit, ok := strings.Cut(field, "=")
+		rate, burst, ok2 := strings.Cut(limit, "/")
+		if !ok || !ok2 || kind == "" {
+			return fmt.Errorf("%q isn't KIND=rate/burst", field)
+		}
+		rt, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return err
+		}
+		b, err := strconv.Atoi(burst)
+		if err != nil {
+			return err
+		}
+		rules[kind] = RateRule{Rate: rt, Burst: b}
+	}
+	*r = rules
+	return nil
+}
+
+func (r RateRules) kinds() []string {
+	kinds := make([]string, 0, len(r))
+	for k := range r {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func (r RateRules) String() string {
+	fields := make([]string, 0, len(r))
+	for _, k := range r.kinds() {
+		fields = append(fields, k+"="+r[k].String())
+	}
+	return strings.Join(fields, " ")
+}
+
+func (r RateRule) String() string {
+	return strconv.FormatFloat(r.Rate, 'g', -1, 64) + "/" + strconv.Itoa(r.Burst)
+}
+
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("durations are strings like \"5m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Every problem at once, so a bad deploy is fixed in one go
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen address is required")
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "TLS needs both a certificate and a key")
+	check(c.TLS.ReloadInterval > 0, "TLS reload interval must be positive")
+	check(c.TLS.AdminClientCA == "" || c.TLS.CertFile != "", "admin client certificates need TLS")
+	check(c.DrainDelay >= 0, "drain delay can't be negative")
+	check(c.PingInterval > 0, "ping interval must be positive")
+	check(c.PongTimeout > c.PingInterval, "pong timeout must be longer than the ping interval")
+	check(c.IdleTimeout > 0, "idle timeout must be positive")
+	check(c.IdleWarning >= 0 && c.IdleWarning < c.IdleTimeout, "idle warning must be between 0 and the idle timeout")
+	check(c.StartingBalance >= 0, "starting balance can't be negative")
+	check(c.HistorySize >= 1, "history size must be at least 1")
+	check(c.Rules.ReloadInterval > 0, "rules reload interval must be positive")
+	check(c.MaxConnections >= 0, "max connections can't be negative")
+	check(c.MaxConnectionsPerIP >= 0, "max connections per IP can't be negative")
+	check(c.MaxMessageSize > 0, "max message size must be positive")
+	check(c.MaxDevices >= 0, "max devices can't be negative")
+	for _, rules := range []RateRules{c.RateLimit.PerConn, c.RateLimit.PerClient, c.RateLimit.PerIP} {
+		for _, kind := range rules.kinds() {
+			r := rules[kind]
+			check(r.Rate > 0 && r.Burst >= 1, "rate limit for %s needs a positive rate and burst, got %s", kind, r)
+		}
+	}
+	check(c.RateLimit.MaxViolations >= 0, "rate limit max violations can't be negative")
+	check(c.RateLimit.MaxViolations == 0 || c.RateLimit.ViolationWindow > 0, "rate limit violation window must be positive")
+	check(c.Tables.Betting > 0, "table betting phase must be positive")
+	check(c.Tables.Locked >= 0 && c.Tables.Result >= 0 && c.Tables.Tick >= 0, "table timings can't be negative")
+	check(c.Jackpot.Percent >= 0 && c.Jackpot.Percent <= 100, "jackpot percent must be between 0 and 100")
+	check(c.Jackpot.Seed >= 0, "jackpot seed can't be negative")
+	check(c.RealityCheckInterval > 0, "reality check interval must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "invalid log level %q", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log format must be text or json, got %q", c.Log.Format)
+	check(c.Log.Sample >= 0, "log sample can't be negative")
+	check(c.Audit.File != "", "audit file is required")
+
+	switch c.Traces {
+	case "", "none", "stdout", "otlp":
+	default:
+		check(false, "traces must be none, stdout or otlp, got %q", c.Traces)
+	}
+
+	if c.OIDC.Issuer != "" {
+		check(c.OIDC.ClientID != "", "OIDC needs a client id")
+		check(c.OIDC.RedirectURL != "", "OIDC needs a redirect URL")
+	}
+
+	return errors.Join(errs...)
+}
+
+// The configuration as log attributes, secrets only say whether they're set
+func (c *Config) LogAttrs() []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(settings))
+	for _, s := range settings {
+		v := format(s.value(c))
+		if s.secret && v != "" {
+			v = "[REDACTED]"
+		}
+		attrs = append(attrs, slog.String(s.flag, v))
+	}
+	return attrs
+}
@@ -0,0 +1,187 @@
+package config_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(k string) string { return vars[k] }
+}
+
+func writeFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(data), 0o600)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	c, err := config.Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	if c.Listen != ":8181" || c.StartingBalance != 100 || c.HistorySize != 10 || c.IdleTimeout != 5*time.Minute || !c.AllowGuests {
+		t.Errorf("Expected the defaults but got %+v", c)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, `{
+		"listen": ":1000",
+		"startingBalance": 50,
+		"historySize": 20,
+		"idleTimeout": "1m",
+		"tls": {"reloadInterval": "30s"},
+		"rules": {"file": "rules.json", "reloadInterval": "1m"},
+		"oidc": {"scopes": ["email"]}
+	}`)
+
+	c, err := config.Load(
+		[]string{"-config", path, "-listen", ":3000"},
+		env(map[string]string{"LISTEN_ADDR": ":2000", "STARTING_BALANCE": "70", "ALLOW_GUESTS": "false"}),
+	)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	if c.Listen != ":3000" {
+		t.Errorf("Expected the flag to win but got %s", c.Listen)
+	}
+	if c.StartingBalance != 70 || c.AllowGuests {
+		t.Errorf("Expected the environment over the file but got %d %v", c.StartingBalance, c.AllowGuests)
+	}
+	if c.HistorySize != 20 || c.IdleTimeout != time.Minute || c.TLS.ReloadInterval != 30*time.Second || len(c.OIDC.Scopes) != 1 {
+		t.Errorf("Expected the file over the defaults but got %+v", c)
+	}
+	if c.Rules.File != "rules.json" || c.Rules.ReloadInterval != time.Minute {
+		t.Errorf("Expected the file over the defaults but got %+v", c)
+	}
+
+	// CONFIG_FILE when there's no -config
+	c, err = config.Load(nil, env(map[string]string{"CONFIG_FILE": path}))
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if c.Listen != ":1000" {
+		t.Errorf("Expected CONFIG_FILE to be read but got %s", c.Listen)
+	}
+}
+
+func TestTunables(t *testing.T) {
+	path := writeFile(t, `{
+		"allowedOrigins": ["https://dice.example.com"],
+		"maxDevices": 2,
+		"rateLimit": {"perClient": {"PLAY": {"rate": 1, "burst": 2}}, "violationWindow": "1m"},
+		"tables": {"betting": "30s", "tick": "0s"},
+		"jackpot": {"seed": 500},
+		"realityCheckInterval": "1h"
+	}`)
+
+	c, err := config.Load(
+		[]string{"-config", path, "-max-connections", "50"},
+		env(map[string]string{"RATE_LIMIT_CONN": "PLAY=1/3 CHALLENGE=0.5/2"}),
+	)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	if len(c.AllowedOrigins) != 1 || c.MaxDevices != 2 || c.MaxConnections != 50 || c.RealityCheckInterval != time.Hour {
+		t.Errorf("Expected the file and flags to be used but got %+v", c)
+	}
+	if c.Tables.Betting != 30*time.Second || c.Tables.Tick != 0 || c.Tables.Locked != 2*time.Second {
+		t.Errorf("Expected the file over the default table timings but got %+v", c.Tables)
+	}
+	if c.Jackpot.Seed != 500 || c.Jackpot.Percent != 1 {
+		t.Errorf("Expected the file over the default jackpot but got %+v", c.Jackpot)
+	}
+
+	// named kinds change, the rest keep their default
+	if got := c.RateLimit.PerConn.String(); got != "*=10/30 CHALLENGE=0.5/2 LOGIN=0.2/5 PLAY=1/3 REGISTER=0.2/5 WALLET=2/10" {
+		t.Errorf("Expected PLAY and CHALLENGE changed but got %s", got)
+	}
+	if got := c.RateLimit.PerClient.String(); got != "*=20/60 PLAY=1/2" {
+		t.Errorf("Expected PLAY added but got %s", got)
+	}
+	if c.RateLimit.ViolationWindow != time.Minute || c.RateLimit.MaxViolations != 20 {
+		t.Errorf("Expected the file over the default violations but got %+v", c.RateLimit)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+	}{
+		{"negative balance", []string{"-starting-balance", "-1"}, nil, ""},
+		{"zero history", nil, map[string]string{"HISTORY_SIZE": "0"}, ""},
+		{"not a number", nil, map[string]string{"HISTORY_SIZE": "ten"}, ""},
+		{"bad duration", []string{"-idle-timeout", "5"}, nil, ""},
+		{"cert without key", []string{"-tls-cert", "cert.pem"}, nil, ""},
+		{"admin CA without TLS", nil, map[string]string{"ADMIN_CLIENT_CA": "ca.pem"}, ""},
+		{"log level", nil, map[string]string{"LOG_LEVEL": "loud"}, ""},
+		{"traces", nil, map[string]string{"OTEL_TRACES_EXPORTER": "zipkin"}, ""},
+		{"oidc without client", nil, map[string]string{"OIDC_ISSUER": "https://idp"}, ""},
+		{"unknown flag", []string{"-port", "80"}, nil, ""},
+		{"unknown field", nil, nil, `{"port": 80}`},
+		{"number duration", nil, nil, `{"idleTimeout": 300}`},
+		{"rules reload interval", []string{"-rules-reload-interval", "0s"}, nil, ""},
+		{"pong before ping", nil, map[string]string{"PING_INTERVAL": "1m", "PONG_TIMEOUT": "30s"}, ""},
+		{"warning after timeout", []string{"-idle-timeout", "1m", "-idle-warning", "2m"}, nil, ""},
+		{"rate limit format", nil, map[string]string{"RATE_LIMIT_CONN": "PLAY=fast"}, ""},
+		{"rate limit without burst", nil, nil, `{"rateLimit": {"perConn": {"PLAY": {"rate": 2}}}}`},
+		{"zero betting phase", []string{"-table-betting", "0s"}, nil, ""},
+		{"jackpot percent", nil, map[string]string{"JACKPOT_PERCENT": "101"}, ""},
+		{"message size", []string{"-max-message-size", "0"}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-config", writeFile(t, tt.file))
+			}
+
+			_, err := config.Load(args, env(tt.env))
+			if err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+func TestLogAttrsRedacted(t *testing.T) {
+	c, err := config.Load(nil, env(map[string]string{
+		"ADMIN_TOKEN":        "admin-secret",
+		"AUDIT_KEY":          "audit-secret",
+		"OIDC_ISSUER":        "https://idp",
+		"OIDC_CLIENT_ID":     "dicegame",
+		"OIDC_CLIENT_SECRET": "oidc-secret",
+		"OIDC_REDIRECT_URL":  "https://dice/auth/oidc/callback",
+	}))
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	var out strings.Builder
+	for _, a := range c.LogAttrs() {
+		out.WriteString(a.String() + " ")
+	}
+	for _, leaked := range []string{"admin-secret", "audit-secret", "oidc-secret"} {
+		if strings.Contains(out.String(), leaked) {
+			t.Errorf("Expected %s to be redacted in %s", leaked, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "oidc-client-id=dicegame") {
+		t.Errorf("Expected the rest to be printed but got %s", out.String())
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/client"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"cgoncalveslck/dicegame/cmd/internal/ratelimit"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Body of POST /register and POST /login
+// clientId is refused, nothing here proves the caller owns that guest, a
+// guest is registered with REGISTER on its own socket
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientId string `json:"clientId"`
+}
+
+// HTTP equivalent of REGISTER, answers with the clientId and token to AUTH
+// the socket with
+func Register(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r, "REGISTER")
+	if !ok {
+		return
+	}
+
+	if creds.ClientId != "" {
+		writeError(w, &client.ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "send REGISTER on the guest's socket to keep its wallet",
+			Code:    client.INVALID_JASON,
+		})
+		return
+	}
+
+	c, cErr := client.RegisterAccount(r.Context(), creds.Username, creds.Password, nil)
+	if cErr != nil {
+		writeError(w, cErr)
+		return
+	}
+
+	profile := c.ProfileSnapshot()
+	writeJSON(w, http.StatusCreated, &client.AccountResultMessage{
+		Kind:     "REGISTER",
+		ClientId: c.Id,
+		Username: creds.Username,
+		Profile:  &profile,
+		Token:    client.IssueLoginToken(c),
+	})
+}
+
+// HTTP equivalent of LOGIN, answers with the clientId and token to AUTH the
+// socket with
+func Login(w http.ResponseWriter, r *http.Request) {
+	creds, ok := readCredentials(w, r, "LOGIN")
+	if !ok {
+		return
+	}
+
+	c, cErr := client.Authenticate(r.Context(), creds.Username, creds.Password)
+	if cErr != nil {
+		writeError(w, cErr)
+		return
+	}
+
+	profile := c.ProfileSnapshot()
+	writeJSON(w, http.StatusOK, &client.AccountResultMessage{
+		Kind:     "LOGIN",
+		ClientId: c.Id,
+		Username: creds.Username,
+		Profile:  &profile,
+		Token:    client.IssueLoginToken(c),
+	})
+}
+
+// Checks method and rate limit and decodes the body, writes the response
+// itself when it returns false
+func readCredentials(w http.ResponseWriter, r *http.Request, kind string) (*credentials, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	d := Limiter.Allow(kind, ratelimit.Keys{IP: ip})
+	if !d.Allowed {
+		writeError(w, &client.ErrorResultMessage{
+			Kind:       "ERROR",
+			Message:    "rate limited",
+			Code:       client.RATE_LIMITED,
+			RetryAfter: int(d.RetryAfter.Milliseconds()),
+		})
+		return nil, false
+	}
+
+	creds := &credentials{}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, Admit.MaxMessageSize)).Decode(creds)
+	if err != nil {
+		writeError(w, &client.ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "failed to parse JSON",
+			Code:    client.INVALID_JASON,
+		})
+		return nil, false
+	}
+
+	return creds, true
+}
+
+func writeError(w http.ResponseWriter, cErr *client.ErrorResultMessage) {
+	metrics.Errors.WithLabelValues(strconv.Itoa(int(cErr.Code))).Inc()
+
+	status := http.StatusBadRequest
+	switch cErr.Code {
+	case client.INVALID_CREDENTIALS:
+		status = http.StatusUnauthorized
+	case client.USERNAME_TAKEN, client.ACCOUNT_EXISTS:
+		status = http.StatusConflict
+	case client.CLIENT_NOT_FOUND:
+		status = http.StatusNotFound
+	case client.ACCOUNT_LOCKED, client.RATE_LIMITED:
+		status = http.StatusTooManyRequests
+	}
+
+	if cErr.RetryAfter > 0 {
+		// header is in whole seconds, round up
+		w.Header().Set("Retry-After", strconv.Itoa((cErr.RetryAfter+999)/1000))
+	}
+
+	writeJSON(w, status, cErr)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn("Encoding response failed", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Decides who gets to open a WebSocket before the upgrade happens
+type Admission struct {
+	// Origins allowed to open sockets, "*" allows any
+	// Requests without an Origin header (non-browser clients) are always allowed
+	AllowedOrigins      []string
+	MaxConnections      int   // 0 means no limit
+	MaxConnectionsPerIP int   // 0 means no limit
+	MaxMessageSize      int64 // bytes, bigger frames close the connection
+
+	conns int
+	perIP map[string]int
+	mx    sync.Mutex
+}
+
+var Admit = &Admission{
+	AllowedOrigins: []string{
+		"http://localhost:3000",
+		"https://dicegame-rho-seven.vercel.app",
+	},
+	MaxConnections:      10000,
+	MaxConnectionsPerIP: 20,
+	MaxMessageSize:      4096,
+	perIP:               make(map[string]int),
+}
+
+func (a *Admission) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range a.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Takes a connection slot for ip
+// Returns the HTTP status and reason to reject with, 0 if it's admitted
+func (a *Admission) acquire(ip string) (int, string) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if a.MaxConnections > 0 && a.conns >= a.MaxConnections {
+		return http.StatusServiceUnavailable, "too many connections"
+	}
+
+	if a.MaxConnectionsPerIP > 0 && a.perIP[ip] >= a.MaxConnectionsPerIP {
+		return http.StatusTooManyRequests, "too many connections from this address"
+	}
+
+	a.conns++
+	a.perIP[ip]++
+	return 0, ""
+}
+
+func (a *Admission) release(ip string) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.conns--
+	a.perIP[ip]--
+	if a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
@@ -2,39 +2,126 @@ package handlers
 
 import (
 	"cgoncalveslck/dicegame/cmd/internal/client"
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"cgoncalveslck/dicegame/cmd/internal/metrics"
+	"cgoncalveslck/dicegame/cmd/internal/ratelimit"
+	"cgoncalveslck/dicegame/cmd/internal/tracing"
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Set from the configuration at startup
+var (
+	PingInterval = 30 * time.Second // how often connections are pinged
+	PongTimeout  = 60 * time.Second // connections silent for longer, pongs included, are closed
+)
+
+// Inbound message limits shared by every connection
+var Limiter = ratelimit.New(ratelimit.DefaultConfig, clock.Real{})
+
+// Kinds the switch below handles, anything else is counted as "other" so
+// clients can't create metric labels
+var kinds = map[string]bool{
+	"AUTH": true, "REGISTER": true, "LOGIN": true, "PLAY": true, "WALLET": true,
+	"STARTPLAY": true, "ENDPLAY": true, "PROFILE": true, "JOIN": true, "LEAVE": true,
+	"BET": true, "CHALLENGE": true, "ACCEPT": true, "DECLINE": true, "TOURNAMENTS": true,
+	"TREGISTER": true, "TPLAY": true, "TSTANDINGS": true, "LIMITS": true, "REALITYACK": true,
+}
+
+func kindLabel(kind string) string {
+	if kinds[kind] {
+		return kind
+	}
+	return "other"
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
 	var upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			return true // CORS local dev
+			return true // already checked by Admit before upgrading
 		},
 	}
 
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if Draining() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !Admit.originAllowed(r) {
+		slog.Info("Upgrade rejected", slog.String("reason", "origin not allowed"), slog.String("origin", r.Header.Get("Origin")), slog.String("ip", ip))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	status, reason := Admit.acquire(ip)
+	if status != 0 {
+		slog.Info("Upgrade rejected", slog.String("reason", reason), slog.String("ip", ip))
+		http.Error(w, reason, status)
+		return
+	}
+	defer Admit.release(ip)
+
+	pingInterval, pongTimeout := PingInterval, PongTimeout
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Upgrade failed: %+v", err)
+		slog.Warn("Upgrade failed", slog.String("ip", ip), slog.Any("error", err))
 
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("WebSocket upgrade failed: " + err.Error()))
 		return
 	}
-	defer func() {
-		conn.Close()
-	}()
+	conn.SetReadLimit(Admit.MaxMessageSize)
+
+	// a client that vanished without a close frame fails the read once the
+	// deadline passes, anything it sends pushes the deadline back
+	alive := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	}
+	alive("")
+	conn.SetPongHandler(alive)
+
+	// each message gets its own trace, linked to the one the upgrade came with
+	link := trace.LinkFromContext(tracing.Extract(r))
 
+	metrics.Connections.Inc()
+	defer metrics.Connections.Dec()
+
+	// not logged in until AUTH, the guest client only talks to this device
+	d := client.NewDevice(conn)
 	c := &client.Client{
-		Conn:      conn,
+		Devices:   []*client.Device{d},
 		Last_seen: time.Now().Unix(),
 	}
+	connId := d.Id
+	clientId := ""
+	d.Log().Debug("Connected")
+
+	done := make(chan struct{})
+	go d.KeepAlive(pingInterval, done)
+
+	defer func() {
+		close(done)
+		// c changes on AUTH, the device belongs to whichever client it ended up with
+		c.Detach(d)
+		conn.Close()
+		Limiter.Forget(connId)
+		d.Log().Debug("Disconnected")
+	}()
 
 	for {
 		if conn == nil {
@@ -43,6 +130,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
 		msg := &client.DefaultMessage{}
 		err = conn.ReadJSON(msg)
+		alive("")
 		if err != nil {
 			// I get 1005 using Insomnia's "Disconnect" and 1001 on browser refresh
 			// I'm guessing 1001 should imply reconnection logic instead of disconnecting like this
@@ -52,7 +140,6 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 				websocket.CloseNoStatusReceived,
 				websocket.CloseAbnormalClosure,
 			) {
-				client.St.DisconnectClient(c)
 				break
 			}
 
@@ -67,53 +154,152 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 					Code:    client.INVALID_JASON,
 				}
 
-				err := c.SendMessage(cErr)
+				err := d.SendMessage(cErr)
 				if err != nil {
-					log.Printf("SendConnMessage error: %+v", err)
+					d.Log().Warn("SendMessage failed", slog.Any("error", err))
 				}
 				continue
 			}
 
+			if errors.Is(err, websocket.ErrReadLimit) {
+				d.Log().Info("Closing connection", slog.String("reason", "message too large"))
+				break
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				d.Log().Info("Closing connection", slog.String("reason", "no pong"))
+				break
+			}
+
 			// Session expired
-			slog.Debug("Read Message error")
+			d.Log().Debug("Read Message error", slog.Any("error", err))
 			break
 		}
 
-		slog.Debug("Received message", slog.String("message", string(msg.Kind)))
+		d.Log().Debug("Received message", slog.String("message", string(msg.Kind)))
+		metrics.Messages.WithLabelValues(kindLabel(msg.Kind)).Inc()
+
+		ctx, span := tracing.Start(context.Background(), "message "+kindLabel(msg.Kind),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithLinks(link),
+			trace.WithAttributes(
+				attribute.String("message.kind", kindLabel(msg.Kind)),
+				attribute.String("conn.id", connId),
+				attribute.String("net.peer.ip", ip),
+			),
+		)
+		ctx = logging.NewContext(ctx, d.Log())
+
+		// the clientId a message claims proves nothing, until AUTH only the
+		// connection and address are limited
+		decision := Limiter.Allow(msg.Kind, ratelimit.Keys{Conn: connId, Client: c.Id, IP: ip})
+		if !decision.Allowed {
+			cErr := &client.ErrorResultMessage{
+				Kind:       "ERROR",
+				Message:    "rate limited",
+				Code:       client.RATE_LIMITED,
+				RetryAfter: int(decision.RetryAfter.Milliseconds()),
+			}
+
+			err := d.SendMessageContext(ctx, cErr)
+			if err != nil {
+				d.Log().Warn("SendMessage failed", slog.Any("error", err))
+			}
+			tracing.ErrorCode(span, int(cErr.Code), cErr.Message)
+			endSpan(span, c)
+
+			if decision.Abusive {
+				d.Log().Info("Disconnecting abusive connection")
+				d.Close(websocket.ClosePolicyViolation, "rate limited")
+				break
+			}
+			continue
+		}
 		if msg.ClientId != "" {
-			cErr := client.HandleClientID(conn, msg)
+			cErr := client.HandleClientID(ctx, conn, msg)
 			if cErr != nil {
-				err := c.SendMessage(cErr)
+				err := d.SendMessageContext(ctx, cErr)
 				if err != nil {
-					log.Printf("SendConnMessage error: %+v", err)
+					d.Log().Warn("SendMessage failed", slog.Any("error", err))
 				}
+				tracing.ErrorCode(span, int(cErr.Code), cErr.Message)
+				endSpan(span, c)
 
 				continue
 			}
 		}
 
-		c.Last_seen = time.Now().Unix()
+		c.Touch()
 		switch string(msg.Kind) {
 		case "PLAY":
-			cErr, err := c.Play(msg)
-			c.HandleMessageErrors(cErr, err, "Play")
+			cErr, err := c.Play(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "Play")
 		case "WALLET":
-			cErr, err := c.GetWallet(msg)
-			c.HandleMessageErrors(cErr, err, "GetWallet")
+			cErr, err := c.GetWallet(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "GetWallet")
 		case "STARTPLAY":
-			cErr, err := c.StartSession(msg)
-			c.HandleMessageErrors(cErr, err, "StartSession")
+			cErr, err := c.StartSession(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "StartSession")
 		case "ENDPLAY":
-			cErr, err := c.EndSession(msg)
-			c.HandleMessageErrors(cErr, err, "EndSession")
+			cErr, err := c.EndSession(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "EndSession")
+		case "PROFILE":
+			cErr, err := c.SetProfile(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "SetProfile")
+		case "JOIN":
+			cErr, err := c.JoinTable(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "JoinTable")
+		case "LEAVE":
+			cErr, err := c.LeaveTable(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "LeaveTable")
+		case "BET":
+			cErr, err := c.TableBet(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "TableBet")
+		case "CHALLENGE":
+			cErr, err := c.Challenge(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "Challenge")
+		case "ACCEPT":
+			cErr, err := c.AcceptDuel(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "AcceptDuel")
+		case "DECLINE":
+			cErr, err := c.DeclineDuel(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "DeclineDuel")
+		case "TOURNAMENTS":
+			cErr, err := c.ListTournaments(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "ListTournaments")
+		case "TREGISTER":
+			cErr, err := c.RegisterTournament(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "RegisterTournament")
+		case "TPLAY":
+			cErr, err := c.PlayTournament(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "PlayTournament")
+		case "TSTANDINGS":
+			cErr, err := c.TournamentStandings(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "TournamentStandings")
+		case "LIMITS":
+			cErr, err := c.SetLimits(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "SetLimits")
+		case "REALITYACK":
+			cErr, err := c.AckRealityCheck(ctx, msg)
+			c.HandleMessageErrors(ctx, cErr, err, "AckRealityCheck")
 		case "AUTH":
-			c, err = c.Auth(conn)
+			c, err = c.Auth(ctx, d, msg)
 			if err != nil {
-				log.Printf("Auth error: %+v", err)
-				err = c.SendMessage(err)
-				if err != nil {
-					log.Printf("SendMessage error: %+v", err)
-				}
+				d.Log().Error("Auth failed", slog.Any("error", err))
+				tracing.Error(span, err)
+			}
+		case "REGISTER":
+			c, err = c.Register(ctx, d, msg)
+			if err != nil {
+				d.Log().Error("Register failed", slog.Any("error", err))
+				tracing.Error(span, err)
+			}
+		case "LOGIN":
+			c, err = c.Login(ctx, d, msg)
+			if err != nil {
+				d.Log().Error("Login failed", slog.Any("error", err))
+				tracing.Error(span, err)
 			}
 		default:
 			msg := &client.ErrorResultMessage{
@@ -122,11 +308,27 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 				Message: "unknown message kind",
 			}
 
-			err := c.SendMessage(msg)
+			err := d.SendMessageContext(ctx, msg)
 			if err != nil {
-				log.Printf("SendMessage error: %+v", err)
-				c.SendMessage(err)
+				d.Log().Warn("SendMessage failed", slog.Any("error", err))
 			}
+			tracing.ErrorCode(span, int(msg.Code), msg.Message)
+		}
+		endSpan(span, c)
+
+		if c.Id != clientId {
+			clientId = c.Id
+			d.Identify(clientId)
 		}
 	}
 }
+
+// Tags the message's span with who sent it, done last since AUTH and LOGIN
+// change the client
+func endSpan(span trace.Span, c *client.Client) {
+	span.SetAttributes(
+		tracing.ClientID(c.Id),
+		attribute.Bool("session.playing", c.Playing()),
+	)
+	span.End()
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/admin"
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"cgoncalveslck/dicegame/cmd/internal/client"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Set at build time with -ldflags "-X cgoncalveslck/dicegame/cmd/internal/handlers.Commit=..."
+// When empty the VCS revision go build embeds is used, if there is one
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+var draining atomic.Bool
+
+// Marks the server as shutting down, /readyz fails and new WebSockets are
+// refused from now on
+func Drain() {
+	draining.Store(true)
+}
+
+func Draining() bool {
+	return draining.Load()
+}
+
+type VersionInfo struct {
+	Version   string         `json:"version"`
+	Commit    string         `json:"commit"`
+	GoVersion string         `json:"goVersion"`
+	Protocols map[string]int `json:"protocols"`
+}
+
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	revision, modified := "unknown", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// GET /healthz, the process is up and serving HTTP
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz, fails while draining or when the audit log can't be written
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+
+	if audit.Default != nil {
+		err := audit.Default.Check()
+		if err != nil {
+			slog.Warn("Not ready", slog.String("reason", "audit log"), slog.Any("error", err))
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": "audit log unavailable"})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /version
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &VersionInfo{
+		Version:   Version,
+		Commit:    commit(),
+		GoVersion: runtime.Version(),
+		Protocols: map[string]int{
+			"websocket": client.ProtocolVersion,
+			"admin":     admin.APIVersion,
+		},
+	})
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/audit"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func get(t *testing.T, h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestReadyz(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := audit.Open(path, nil)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer l.Close()
+
+	audit.Default = l
+	t.Cleanup(func() {
+		audit.Default = nil
+		draining.Store(false)
+	})
+
+	if rec := get(t, Healthz, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected /healthz 200 but got %d", rec.Code)
+	}
+	if rec := get(t, Readyz, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected /readyz 200 but got %d", rec.Code)
+	}
+
+	os.Remove(path)
+	if rec := get(t, Readyz, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 without the audit log but got %d", rec.Code)
+	}
+	audit.Default = nil
+
+	Drain()
+	if rec := get(t, Readyz, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 while draining but got %d", rec.Code)
+	}
+	if rec := get(t, Healthz, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected /healthz to stay 200 while draining but got %d", rec.Code)
+	}
+	if rec := get(t, Handler, "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected new WebSockets to be refused while draining but got %d", rec.Code)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	rec := get(t, VersionHandler, "/version")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", rec.Code)
+	}
+
+	v := &VersionInfo{}
+	err := json.NewDecoder(rec.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if v.GoVersion != runtime.Version() || v.Commit == "" {
+		t.Errorf("Expected build info but got %+v", v)
+	}
+	if v.Protocols["websocket"] == 0 || v.Protocols["admin"] == 0 {
+		t.Errorf("Expected protocol versions but got %+v", v.Protocols)
+	}
+}
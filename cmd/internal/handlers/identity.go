@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/client"
+	"cgoncalveslck/dicegame/cmd/internal/identity"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Identity providers players can log in with, by the name used in the URL
+var Providers = map[string]identity.Provider{}
+
+func provider(w http.ResponseWriter, r *http.Request) (identity.Provider, bool) {
+	p, ok := Providers[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+	}
+	return p, ok
+}
+
+// GET /auth/{provider}/login, sends the browser to the provider
+func IdentityLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := provider(w, r)
+	if !ok {
+		return
+	}
+
+	redirect, err := p.Begin()
+	if err != nil {
+		slog.Error("Identity login failed", slog.String("provider", p.Name()), slog.Any("error", err))
+		http.Error(w, "login unavailable", http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// GET /auth/{provider}/callback, where the provider sends the browser back
+// Answers with the clientId and token to AUTH the socket with
+func IdentityCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := provider(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		slog.Info("Identity login refused", slog.String("provider", p.Name()), slog.String("error", e))
+		writeError(w, &client.ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "login refused by the provider",
+			Code:    client.INVALID_CREDENTIALS,
+		})
+		return
+	}
+
+	id, err := p.Finish(r.Context(), q.Get("state"), q.Get("code"))
+	if err != nil {
+		slog.Info("Identity login failed", slog.String("provider", p.Name()), slog.String("error", err.Error()))
+
+		// anything else is the provider or the network, not the player
+		if !errors.Is(err, identity.ErrUnknownState) && !errors.Is(err, identity.ErrInvalidToken) {
+			http.Error(w, "login unavailable", http.StatusBadGateway)
+			return
+		}
+
+		writeError(w, &client.ErrorResultMessage{
+			Kind:    "ERROR",
+			Message: "login failed",
+			Code:    client.INVALID_CREDENTIALS,
+		})
+		return
+	}
+
+	c := client.LoginIdentity(r.Context(), id)
+	profile := c.ProfileSnapshot()
+	writeJSON(w, http.StatusOK, &client.IdentityResultMessage{
+		Kind:     "LOGIN",
+		ClientId: c.Id,
+		Identity: id,
+		Profile:  &profile,
+		Token:    client.IssueLoginToken(c),
+	})
+}
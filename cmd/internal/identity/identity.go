@@ -0,0 +1,29 @@
+package identity
+
+import (
+	"context"
+	"errors"
+)
+
+// Who a provider says the player is
+// Subject is stable for the provider, the rest is informational
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+// Something players can log in with instead of anonymous AUTH
+// Logins are two steps, Begin gives the URL to send the browser to and the
+// provider redirects back with what Finish needs
+type Provider interface {
+	Name() string
+	Begin() (redirect string, err error)
+	Finish(ctx context.Context, state, code string) (*Identity, error)
+}
+
+var (
+	ErrUnknownState = errors.New("unknown or expired login state")
+	ErrInvalidToken = errors.New("invalid id token")
+)
@@ -0,0 +1,397 @@
+package identity
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDCConfig struct {
+	Issuer       string // discovery is fetched from Issuer + "/.well-known/openid-configuration"
+	ClientID     string
+	ClientSecret string // optional, public clients rely on PKCE alone
+	RedirectURL  string
+	Scopes       []string // "openid" is always sent
+}
+
+const (
+	// how long a player has to finish logging in at the provider
+	loginTimeout = 10 * time.Minute
+	// accepted difference between our clock and the issuer's
+	clockSkew = time.Minute
+	// unknown key ids refetch the JWKS, but not more often than this
+	jwksRefresh = 30 * time.Second
+)
+
+// Authorization code flow with PKCE, ID tokens checked against the issuer's JWKS
+// Only RS256 is accepted
+type OIDC struct {
+	cfg    OIDCConfig
+	clock  clock.Clock
+	client *http.Client
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	pending    map[string]pendingLogin // map[state]
+	keys       map[string]*rsa.PublicKey
+	keysLoaded time.Time
+	mx         sync.Mutex
+}
+
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Fetches the issuer's discovery document, fails if it doesn't describe cfg.Issuer
+func NewOIDC(ctx context.Context, cfg OIDCConfig, c clock.Clock) (*OIDC, error) {
+	o := &OIDC{
+		cfg:     cfg,
+		clock:   c,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string]pendingLogin),
+		keys:    make(map[string]*rsa.PublicKey),
+	}
+
+	d := &discovery{}
+	err := o.getJSON(ctx, strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if d.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q doesn't match %q", d.Issuer, cfg.Issuer)
+	}
+
+	o.authURL = d.AuthorizationEndpoint
+	o.tokenURL = d.TokenEndpoint
+	o.jwksURL = d.JwksURI
+	return o, nil
+}
+
+func (o *OIDC) Name() string {
+	return "oidc"
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (o *OIDC) Begin() (string, error) {
+	state := randomString(16)
+	verifier := randomString(32)
+	nonce := randomString(16)
+
+	o.mx.Lock()
+	now := o.clock.Now()
+	// drop logins nobody came back from
+	for s, p := range o.pending {
+		if now.After(p.expires) {
+			delete(o.pending, s)
+		}
+	}
+	o.pending[state] = pendingLogin{
+		verifier: verifier,
+		nonce:    nonce,
+		expires:  now.Add(loginTimeout),
+	}
+	o.mx.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := append([]string{"openid"}, o.cfg.Scopes...)
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.cfg.ClientID)
+	q.Set("redirect_uri", o.cfg.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(o.authURL, "?") {
+		sep = "&"
+	}
+	return o.authURL + sep + q.Encode(), nil
+}
+
+func (o *OIDC) Finish(ctx context.Context, state, code string) (*Identity, error) {
+	// a state can only be used once
+	o.mx.Lock()
+	p, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mx.Unlock()
+	if !ok || o.clock.Now().After(p.expires) {
+		return nil, ErrUnknownState
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.cfg.RedirectURL)
+	form.Set("client_id", o.cfg.ClientID)
+	form.Set("code_verifier", p.verifier)
+	if o.cfg.ClientSecret != "" {
+		form.Set("client_secret", o.cfg.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc token: status %d", resp.StatusCode)
+	}
+
+	tokens := &struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+
+	claims, err := o.verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != p.nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return &Identity{
+		Provider: o.Name(),
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		Name:     claims.Name,
+	}, nil
+}
+
+// "aud" can be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*a = many
+	return err
+}
+
+type idClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expires   int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+	Nonce     string   `json:"nonce"`
+	Email     string   `json:"email"`
+	Name      string   `json:"name"`
+	AuthParty string   `json:"azp"`
+}
+
+// Checks the signature and the standard claims of an ID token
+func (o *OIDC) verify(ctx context.Context, token string) (*idClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	header := &struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeSegment(parts[0], header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	// never trust "none" or HMAC with a public key
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, header.Alg)
+	}
+
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	claims := &idClaims{}
+	err = decodeSegment(parts[1], claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+
+	if claims.Issuer != o.cfg.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+
+	found := false
+	for _, aud := range claims.Audience {
+		if aud == o.cfg.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: audience", ErrInvalidToken)
+	}
+	if len(claims.Audience) > 1 && claims.AuthParty != o.cfg.ClientID {
+		return nil, fmt.Errorf("%w: authorized party", ErrInvalidToken)
+	}
+
+	now := o.clock.Now()
+	if now.After(time.Unix(claims.Expires, 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Signing key by id, refetches the JWKS once when it's unknown since
+// issuers rotate keys
+func (o *OIDC) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	o.mx.Lock()
+	key, ok := o.keys[kid]
+	stale := o.clock.Now().Sub(o.keysLoaded) >= jwksRefresh
+	o.mx.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	keys, err := o.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mx.Lock()
+	o.keys = keys
+	o.keysLoaded = o.clock.Now()
+	o.mx.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+	return key, nil
+}
+
+func (o *OIDC) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	set := &struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err := o.getJSON(ctx, o.jwksURL, set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func (o *OIDC) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
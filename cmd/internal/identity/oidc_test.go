@@ -0,0 +1,258 @@
+package identity_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"cgoncalveslck/dicegame/cmd/internal/identity"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Just enough of an OIDC issuer to log in against
+type stubIssuer struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	now   time.Time
+	codes map[string]url.Values // map[code]authorize request
+	mx    sync.Mutex
+
+	// lets a test break the ID token
+	claims func(c map[string]interface{})
+}
+
+func newStubIssuer(t *testing.T, now time.Time) *stubIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	s := &stubIssuer{key: key, now: now, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	// logs everyone in as "alice" and redirects back with a code
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := "code-" + q.Get("state")
+
+		s.mx.Lock()
+		s.codes[code] = q
+		s.mx.Unlock()
+
+		back := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, back, http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		s.mx.Lock()
+		auth, ok := s.codes[r.PostForm.Get("code")]
+		delete(s.codes, r.PostForm.Get("code"))
+		s.mx.Unlock()
+		if !ok {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != auth.Get("code_challenge") {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   s.URL,
+			"sub":   "alice-123",
+			"aud":   auth.Get("client_id"),
+			"exp":   s.now.Add(time.Hour).Unix(),
+			"iat":   s.now.Unix(),
+			"nonce": auth.Get("nonce"),
+			"email": "alice@example.com",
+			"name":  "Alice",
+		}
+		if s.claims != nil {
+			s.claims(claims)
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     s.sign(t, claims),
+		})
+	})
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *stubIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Plays the browser, follows the provider redirect and returns state and code
+func authorize(t *testing.T, redirect string) (string, string) {
+	c := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := c.Get(redirect)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	resp.Body.Close()
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	return loc.Query().Get("state"), loc.Query().Get("code")
+}
+
+func newOIDC(t *testing.T, issuer *stubIssuer, now time.Time) *identity.OIDC {
+	o, err := identity.NewOIDC(context.Background(), identity.OIDCConfig{
+		Issuer:      issuer.URL,
+		ClientID:    "dicegame",
+		RedirectURL: "http://localhost:8181/auth/oidc/callback",
+	}, clock.NewFake(now))
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	return o
+}
+
+func TestOIDCLogin(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	issuer := newStubIssuer(t, now)
+	defer issuer.Close()
+	o := newOIDC(t, issuer, now)
+
+	redirect, err := o.Begin()
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	u, _ := url.Parse(redirect)
+	if u.Query().Get("code_challenge_method") != "S256" {
+		t.Errorf("Expected PKCE S256 but got %q", u.Query().Get("code_challenge_method"))
+	}
+
+	state, code := authorize(t, redirect)
+	id, err := o.Finish(context.Background(), state, code)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	if id.Subject != "alice-123" || id.Provider != "oidc" || id.Email != "alice@example.com" {
+		t.Errorf("Unexpected identity %+v", id)
+	}
+
+	// states are single use
+	_, err = o.Finish(context.Background(), state, code)
+	if !errors.Is(err, identity.ErrUnknownState) {
+		t.Errorf("Expected ErrUnknownState but got %v", err)
+	}
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name   string
+		claims func(c map[string]interface{})
+	}{
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newStubIssuer(t, now)
+			defer issuer.Close()
+			issuer.claims = tt.claims
+			o := newOIDC(t, issuer, now)
+
+			redirect, err := o.Begin()
+			if err != nil {
+				t.Fatalf("Error: %+v", err)
+			}
+
+			state, code := authorize(t, redirect)
+			_, err = o.Finish(context.Background(), state, code)
+			if !errors.Is(err, identity.ErrInvalidToken) {
+				t.Errorf("Expected ErrInvalidToken but got %v", err)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginExpires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	issuer := newStubIssuer(t, now)
+	defer issuer.Close()
+
+	fake := clock.NewFake(now)
+	o, err := identity.NewOIDC(context.Background(), identity.OIDCConfig{
+		Issuer:      issuer.URL,
+		ClientID:    "dicegame",
+		RedirectURL: "http://localhost:8181/auth/oidc/callback",
+	}, fake)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	redirect, _ := o.Begin()
+	state, code := authorize(t, redirect)
+
+	fake.Advance(11 * time.Minute)
+	_, err = o.Finish(context.Background(), state, code)
+	if !errors.Is(err, identity.ErrUnknownState) {
+		t.Errorf("Expected ErrUnknownState but got %v", err)
+	}
+}
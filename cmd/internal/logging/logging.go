@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+type Config struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+
+	// only 1 in SampleEvery of the Sampled debug lines are written, 0 or 1
+	// writes them all
+	SampleEvery int
+	Sampled     []string
+}
+
+// Debug lines written for every message, too many to keep them all
+var DefaultSampled = []string{"Received message", "Sent message"}
+
+// Attribute keys whose values never make it to the output
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"token":         true,
+	"access_token":  true,
+	"id_token":      true,
+	"password":      true,
+	"secret":        true,
+	"client_secret": true,
+}
+
+const redacted = "[REDACTED]"
+
+// Attribute keys holding client ids, a guest's id is all it takes to log in
+// as them so only its Pseudonym is written
+var identifierKeys = map[string]bool{
+	"clientid":   true,
+	"opponentid": true,
+	"winnerid":   true,
+}
+
+// What is written instead of a client id, the same for every line of a
+// client so its activity can still be followed
+func Pseudonym(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Builds the logger everything else uses
+func New(w io.Writer, cfg Config) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cfg.Level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+
+	var h slog.Handler
+	switch cfg.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	if cfg.SampleEvery > 1 && len(cfg.Sampled) > 0 {
+		h = newSampler(h, cfg.SampleEvery, cfg.Sampled)
+	}
+	return slog.New(h), nil
+}
+
+type ctxKey struct{}
+
+// ctx carrying l, for code that gets a context but not a logger
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// The logger NewContext put in ctx, the default one if there's none
+func FromContext(ctx context.Context) *slog.Logger {
+	l, ok := ctx.Value(ctxKey{}).(*slog.Logger)
+	if !ok {
+		return slog.Default()
+	}
+	return l
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	if identifierKeys[strings.ToLower(a.Key)] && a.Value.Kind() == slog.KindString && a.Value.String() != "" {
+		return slog.String(a.Key, Pseudonym(a.Value.String()))
+	}
+
+	if a.Value.Kind() == slog.KindString {
+		v := a.Value.String()
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return slog.String(a.Key, "Bearer "+redacted)
+		}
+	}
+	return a
+}
+
+// Drops all but 1 in every n debug records whose message is in messages,
+// the kept ones say how many they stand for
+type sampler struct {
+	next     slog.Handler
+	every    int
+	counters map[string]*atomic.Uint64 // shared by the handlers WithAttrs makes
+}
+
+func newSampler(next slog.Handler, every int, messages []string) *sampler {
+	counters := make(map[string]*atomic.Uint64, len(messages))
+	for _, m := range messages {
+		counters[m] = &atomic.Uint64{}
+	}
+	return &sampler{next: next, every: every, counters: counters}
+}
+
+func (s *sampler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.next.Enabled(ctx, level)
+}
+
+func (s *sampler) Handle(ctx context.Context, r slog.Record) error {
+	counter, ok := s.counters[r.Message]
+	if ok && r.Level <= slog.LevelDebug {
+		if (counter.Add(1)-1)%uint64(s.every) != 0 {
+			return nil
+		}
+		r.AddAttrs(slog.Int("sampled", s.every))
+	}
+	return s.next.Handle(ctx, r)
+}
+
+func (s *sampler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampler{next: s.next.WithAttrs(attrs), every: s.every, counters: s.counters}
+}
+
+func (s *sampler) WithGroup(name string) slog.Handler {
+	return &sampler{next: s.next.WithGroup(name), every: s.every, counters: s.counters}
+}
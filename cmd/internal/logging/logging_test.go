@@ -0,0 +1,109 @@
+package logging_test
+
+import (
+	"bytes"
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func lines(buf *bytes.Buffer) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if l == "" {
+			continue
+		}
+		m := map[string]interface{}{}
+		json.Unmarshal([]byte(l), &m)
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestLevelAndFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l, err := logging.New(buf, logging.Config{Level: "warn", Format: "json"})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	l.Info("dropped")
+	l.Warn("kept", slog.String("clientId", "c1"))
+
+	ls := lines(buf)
+	if len(ls) != 1 || ls[0]["msg"] != "kept" || ls[0]["clientId"] != logging.Pseudonym("c1") {
+		t.Errorf("Expected only the warning as JSON but got %s", buf.String())
+	}
+
+	_, err = logging.New(buf, logging.Config{Level: "loud"})
+	if err == nil {
+		t.Errorf("Expected an invalid level to fail")
+	}
+	_, err = logging.New(buf, logging.Config{Level: "info", Format: "xml"})
+	if err == nil {
+		t.Errorf("Expected an invalid format to fail")
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l, _ := logging.New(buf, logging.Config{Level: "info", Format: "text"})
+
+	l.Info("request",
+		slog.String("password", "hunter22"),
+		slog.String("Token", "s3cr3t"),
+		slog.String("header", "Bearer abc.def"),
+		slog.Group("oidc", slog.String("client_secret", "shh")),
+	)
+	l.With(slog.String("clientId", "guest-1")).Info("play", slog.String("opponentId", "guest-2"))
+
+	out := buf.String()
+	for _, leaked := range []string{"hunter22", "s3cr3t", "abc.def", "shh", "guest-1", "guest-2"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("Expected %q to be redacted in %s", leaked, out)
+		}
+	}
+	// ids are replaced by the same pseudonym on every line
+	if !strings.Contains(out, "clientId="+logging.Pseudonym("guest-1")) || logging.Pseudonym("guest-1") == logging.Pseudonym("guest-2") {
+		t.Errorf("Expected clientId to be written as its pseudonym in %s", out)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l, _ := logging.New(buf, logging.Config{Level: "debug", Format: "json", SampleEvery: 10, Sampled: []string{"Sent message"}})
+	l = l.With(slog.String("conn", "x")) // samplers made by With share the count
+
+	for i := 0; i < 25; i++ {
+		l.Debug("Sent message")
+		l.Debug("Other")
+	}
+	l.Info("Sent message") // only debug lines are sampled
+
+	sent, other := 0, 0
+	for _, m := range lines(buf) {
+		switch m["msg"] {
+		case "Sent message":
+			sent++
+		case "Other":
+			other++
+		}
+	}
+	if sent != 3+1 || other != 25 {
+		t.Errorf("Expected 3 sampled lines plus the info one and 25 others but got %d and %d", sent, other)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if logging.FromContext(context.Background()) != slog.Default() {
+		t.Errorf("Expected the default logger without one in the context")
+	}
+
+	l := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if logging.FromContext(logging.NewContext(context.Background(), l)) != l {
+		t.Errorf("Expected the logger from the context")
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Everything is registered on the default registry, served by promhttp.Handler
+var (
+	Connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "dicegame_connections_active",
+		Help: "Open WebSocket connections.",
+	})
+
+	Messages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dicegame_messages_received_total",
+		Help: "Inbound messages by kind, unknown kinds are counted as \"other\".",
+	}, []string{"kind"})
+
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dicegame_errors_total",
+		Help: "Error messages sent to clients by code.",
+	}, []string{"code"})
+
+	Plays = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dicegame_plays_total",
+		Help: "PLAY rolls by choice and result.",
+	}, []string{"choice", "result"})
+
+	Wagered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dicegame_wagered_points_total",
+		Help: "Points bet against the house (PLAY and tables).",
+	})
+
+	PaidOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dicegame_paid_out_points_total",
+		Help: "Points paid back by the house, stakes included, jackpots too.",
+	})
+
+	SendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dicegame_send_duration_seconds",
+		Help:    "Time to write one message to a WebSocket.",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	})
+)
+
+// Counters can't be read back, keep the totals for the RTP gauge
+var wagered, paidOut atomic.Int64
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dicegame_rtp_ratio",
+		Help: "Realized return to player, paid out over wagered since start.",
+	}, func() float64 {
+		w := wagered.Load()
+		if w == 0 {
+			return 0
+		}
+		return float64(paidOut.Load()) / float64(w)
+	})
+}
+
+func Wager(points int) {
+	Wagered.Add(float64(points))
+	wagered.Add(int64(points))
+}
+
+func Payout(points int) {
+	PaidOut.Add(float64(points))
+	paidOut.Add(int64(points))
+}
+
+// Gauges read from the store on every scrape, the store can't be imported
+// from here so it hands over how to count
+func RegisterStore(clients, sessions func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dicegame_clients",
+		Help: "Clients in the store, connected or not.",
+	}, func() float64 {
+		return float64(clients())
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dicegame_sessions_active",
+		Help: "Clients with a session running.",
+	}, func() float64 {
+		return float64(sessions())
+	})
+}
@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket refilled at Rate tokens per second, holding at most Burst
+type Rule struct {
+	Rate  float64
+	Burst int
+}
+
+// Rules by message kind, "*" covers every kind without its own rule
+type Rules map[string]Rule
+
+type Config struct {
+	PerConn   Rules
+	PerClient Rules
+	PerIP     Rules
+
+	// a connection that gets limited more than MaxViolations times
+	// within ViolationWindow is treated as abusive, 0 disables it
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+var DefaultConfig = Config{
+	PerConn: Rules{
+		"*":      {Rate: 10, Burst: 30},
+		"PLAY":   {Rate: 5, Burst: 15},
+		"WALLET": {Rate: 2, Burst: 10},
+		// password guessing, accounts also lock themselves
+		"LOGIN":    {Rate: 0.2, Burst: 5},
+		"REGISTER": {Rate: 0.2, Burst: 5},
+	},
+	PerClient: Rules{
+		"*": {Rate: 20, Burst: 60},
+	},
+	// generous, a whole office can sit behind one address
+	PerIP: Rules{
+		"*":        {Rate: 100, Burst: 300},
+		"LOGIN":    {Rate: 1, Burst: 20},
+		"REGISTER": {Rate: 1, Burst: 20},
+	},
+	MaxViolations:   20,
+	ViolationWindow: 10 * time.Second,
+}
+
+// Who sent the message, empty keys skip that scope
+type Keys struct {
+	Conn   string
+	Client string
+	IP     string
+}
+
+type Decision struct {
+	Allowed    bool
+	RetryAfter time.Duration
+	Abusive    bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type Limiter struct {
+	cfg        Config
+	clock      clock.Clock
+	buckets    map[string]*bucket
+	violations map[string][]time.Time // map[connKey]violation times
+	lastPrune  time.Time
+	mx         sync.Mutex
+}
+
+func New(cfg Config, c clock.Clock) *Limiter {
+	return &Limiter{
+		cfg:        cfg,
+		clock:      c,
+		buckets:    make(map[string]*bucket),
+		violations: make(map[string][]time.Time),
+		lastPrune:  c.Now(),
+	}
+}
+
+func (r Rules) lookup(kind string) (string, Rule, bool) {
+	if rule, ok := r[kind]; ok {
+		return kind, rule, true
+	}
+	rule, ok := r["*"]
+	return "*", rule, ok
+}
+
+// Refills b up to now, caller must hold l.mx
+func (b *bucket) refill(rule Rule, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(rule.Burst), b.tokens+elapsed*rule.Rate)
+	b.last = now
+}
+
+// Takes a token from every scope or from none of them
+// RetryAfter is how long until every scope has a token again
+func (l *Limiter) Allow(kind string, k Keys) Decision {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := l.clock.Now()
+	l.prune(now)
+
+	var hits []*bucket
+
+	scopes := []struct {
+		name  string
+		key   string
+		rules Rules
+	}{
+		{"conn", k.Conn, l.cfg.PerConn},
+		{"client", k.Client, l.cfg.PerClient},
+		{"ip", k.IP, l.cfg.PerIP},
+	}
+
+	var retry time.Duration
+	for _, s := range scopes {
+		if s.key == "" {
+			continue
+		}
+		name, rule, ok := s.rules.lookup(kind)
+		if !ok || rule.Rate <= 0 {
+			continue
+		}
+
+		id := s.name + "|" + s.key + "|" + name
+		b, ok := l.buckets[id]
+		if !ok {
+			b = &bucket{tokens: float64(rule.Burst), last: now}
+			l.buckets[id] = b
+		}
+		b.refill(rule, now)
+
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / rule.Rate * float64(time.Second))
+			retry = max(retry, wait)
+		}
+		hits = append(hits, b)
+	}
+
+	if retry == 0 {
+		for _, b := range hits {
+			b.tokens--
+		}
+		return Decision{Allowed: true}
+	}
+
+	return Decision{
+		RetryAfter: retry,
+		Abusive:    l.violation(k.Conn, now),
+	}
+}
+
+// Records a violation for conn, true once it's over the limit
+// Caller must hold l.mx
+func (l *Limiter) violation(conn string, now time.Time) bool {
+	if conn == "" || l.cfg.MaxViolations <= 0 {
+		return false
+	}
+
+	times := l.violations[conn]
+	cutoff := now.Add(-l.cfg.ViolationWindow)
+	for len(times) > 0 && !times[0].After(cutoff) {
+		times = times[1:]
+	}
+	times = append(times, now)
+	l.violations[conn] = times
+
+	return len(times) > l.cfg.MaxViolations
+}
+
+// Drops everything kept for a closed connection
+func (l *Limiter) Forget(conn string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	prefix := "conn|" + conn + "|"
+	for id := range l.buckets {
+		if strings.HasPrefix(id, prefix) {
+			delete(l.buckets, id)
+		}
+	}
+	delete(l.violations, conn)
+}
+
+// Buckets idle for 10 minutes are full again for any sane rule so dropping
+// them changes nothing, same for old violations
+// Only runs once a minute, caller must hold l.mx
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for id, b := range l.buckets {
+		if now.Sub(b.last) >= 10*time.Minute {
+			delete(l.buckets, id)
+		}
+	}
+
+	for conn, times := range l.violations {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= l.cfg.ViolationWindow {
+			delete(l.violations, conn)
+		}
+	}
+}
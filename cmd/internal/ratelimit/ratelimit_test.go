@@ -0,0 +1,120 @@
+package ratelimit_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"cgoncalveslck/dicegame/cmd/internal/ratelimit"
+	"testing"
+	"time"
+)
+
+func TestBurstAndRefill(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	l := ratelimit.New(ratelimit.Config{
+		PerConn: ratelimit.Rules{"*": {Rate: 2, Burst: 3}},
+	}, fake)
+
+	keys := ratelimit.Keys{Conn: "c1"}
+	for i := 0; i < 3; i++ {
+		if d := l.Allow("WALLET", keys); !d.Allowed {
+			t.Fatalf("Expected message %d to be allowed", i)
+		}
+	}
+
+	d := l.Allow("WALLET", keys)
+	if d.Allowed {
+		t.Fatalf("Expected burst to be used up")
+	}
+
+	if d.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Expected retry after 500ms but got %s", d.RetryAfter)
+	}
+
+	fake.Advance(500 * time.Millisecond)
+	if d := l.Allow("WALLET", keys); !d.Allowed {
+		t.Errorf("Expected a token after refill")
+	}
+
+	// other connections have their own bucket
+	if d := l.Allow("WALLET", ratelimit.Keys{Conn: "c2"}); !d.Allowed {
+		t.Errorf("Expected c2 to be allowed")
+	}
+}
+
+func TestPerKindRules(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	l := ratelimit.New(ratelimit.Config{
+		PerConn: ratelimit.Rules{
+			"*":    {Rate: 10, Burst: 10},
+			"PLAY": {Rate: 1, Burst: 1},
+		},
+	}, fake)
+
+	keys := ratelimit.Keys{Conn: "c1"}
+	if d := l.Allow("PLAY", keys); !d.Allowed {
+		t.Fatalf("Expected first PLAY to be allowed")
+	}
+
+	if d := l.Allow("PLAY", keys); d.Allowed || d.RetryAfter != time.Second {
+		t.Errorf("Expected second PLAY to wait 1s but got %+v", d)
+	}
+
+	if d := l.Allow("WALLET", keys); !d.Allowed {
+		t.Errorf("Expected WALLET to use its own bucket")
+	}
+}
+
+func TestScopesAreAllOrNothing(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	l := ratelimit.New(ratelimit.Config{
+		PerConn: ratelimit.Rules{"*": {Rate: 1, Burst: 5}},
+		PerIP:   ratelimit.Rules{"*": {Rate: 1, Burst: 2}},
+	}, fake)
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow("PLAY", ratelimit.Keys{Conn: "c1", IP: "10.0.0.1"}); !d.Allowed {
+			t.Fatalf("Expected message %d to be allowed", i)
+		}
+	}
+
+	// the address is out of tokens, the connection isn't
+	if d := l.Allow("PLAY", ratelimit.Keys{Conn: "c2", IP: "10.0.0.1"}); d.Allowed {
+		t.Errorf("Expected IP limit to apply to a new connection")
+	}
+
+	// a refused message mustn't have used c2's tokens
+	for i := 0; i < 5; i++ {
+		if d := l.Allow("PLAY", ratelimit.Keys{Conn: "c2"}); !d.Allowed {
+			t.Errorf("Expected c2 to still have 5 tokens, ran out at %d", i)
+		}
+	}
+}
+
+func TestAbusiveConnection(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	l := ratelimit.New(ratelimit.Config{
+		PerConn:         ratelimit.Rules{"*": {Rate: 1, Burst: 1}},
+		MaxViolations:   3,
+		ViolationWindow: 10 * time.Second,
+	}, fake)
+
+	keys := ratelimit.Keys{Conn: "c1"}
+	l.Allow("PLAY", keys)
+
+	for i := 0; i < 3; i++ {
+		if d := l.Allow("PLAY", keys); d.Allowed || d.Abusive {
+			t.Fatalf("Expected violation %d to be limited but not abusive, got %+v", i, d)
+		}
+	}
+
+	if d := l.Allow("PLAY", keys); !d.Abusive {
+		t.Errorf("Expected connection to be abusive after 4 violations")
+	}
+
+	// old violations fall out of the window
+	l.Forget("c1")
+	fake.Advance(11 * time.Second)
+	l.Allow("PLAY", keys)
+	if d := l.Allow("PLAY", keys); d.Abusive {
+		t.Errorf("Expected a fresh start after Forget")
+	}
+}
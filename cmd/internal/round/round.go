@@ -0,0 +1,175 @@
+package round
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	Betting Phase = "BETTING" // bets accepted
+	Locked  Phase = "LOCKED"  // bets closed, waiting for the roll
+	Result  Phase = "RESULT"  // rolled, showing results until the next round
+)
+
+type Config struct {
+	Betting time.Duration
+	Locked  time.Duration
+	Result  time.Duration
+	Tick    time.Duration // countdown interval, 0 disables ticks
+}
+
+// A phase transition or, when Tick is set, a countdown tick inside a phase
+type Event struct {
+	Round     int
+	Phase     Phase
+	Tick      bool
+	Remaining time.Duration
+	Roll      int // only set on Result
+}
+
+// Scheduler runs rounds on its own: betting, locked, roll, result, repeat
+// Subscribers get every event in order on the scheduler goroutine,
+// they shouldn't block for long or every other subscriber waits too
+type Scheduler struct {
+	cfg   Config
+	clock clock.Clock
+	roll  func() int
+
+	subs   map[int]func(Event)
+	nextId int
+	round  int
+	phase  Phase
+	endsAt time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	mx       sync.Mutex
+}
+
+func New(cfg Config, c clock.Clock, roll func() int) *Scheduler {
+	return &Scheduler{
+		cfg:   cfg,
+		clock: c,
+		roll:  roll,
+		subs:  make(map[int]func(Event)),
+		stop:  make(chan struct{}),
+	}
+}
+
+// Returns a func that removes the subscription
+func (s *Scheduler) Subscribe(fn func(Event)) func() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	id := s.nextId
+	s.nextId++
+	s.subs[id] = fn
+
+	return func() {
+		s.mx.Lock()
+		delete(s.subs, id)
+		s.mx.Unlock()
+	}
+}
+
+// Current round, phase and when that phase ends
+func (s *Scheduler) State() (int, Phase, time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.round, s.phase, s.endsAt
+}
+
+// Runs rounds until Stop is called
+func (s *Scheduler) Run() {
+	for {
+		s.mx.Lock()
+		s.round++
+		round := s.round
+		s.mx.Unlock()
+
+		if !s.runPhase(round, Betting, s.cfg.Betting, 0) {
+			return
+		}
+		if !s.runPhase(round, Locked, s.cfg.Locked, 0) {
+			return
+		}
+
+		num := s.roll()
+		slog.Debug("Round rolled", slog.Int("round", round), slog.Int("roll", num))
+		if !s.runPhase(round, Result, s.cfg.Result, num) {
+			return
+		}
+	}
+}
+
+// Doesn't wait for Run to return, so it's safe to call from a subscriber
+// or while holding a lock a subscriber needs
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Publishes the transition and ticks until the phase is over
+// Returns false if the scheduler was stopped
+func (s *Scheduler) runPhase(round int, phase Phase, d time.Duration, roll int) bool {
+	end := s.clock.Now().Add(d)
+
+	s.mx.Lock()
+	s.phase = phase
+	s.endsAt = end
+	s.mx.Unlock()
+
+	if !s.publish(Event{Round: round, Phase: phase, Remaining: d, Roll: roll}) {
+		return false
+	}
+
+	for {
+		remaining := end.Sub(s.clock.Now())
+		if remaining <= 0 {
+			return true
+		}
+
+		step := remaining
+		if s.cfg.Tick > 0 && s.cfg.Tick < step {
+			step = s.cfg.Tick
+		}
+
+		select {
+		case <-s.clock.After(step):
+		case <-s.stop:
+			return false
+		}
+
+		remaining = end.Sub(s.clock.Now())
+		if remaining > 0 {
+			if !s.publish(Event{Round: round, Phase: phase, Tick: true, Remaining: remaining}) {
+				return false
+			}
+		}
+	}
+}
+
+func (s *Scheduler) publish(e Event) bool {
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+
+	s.mx.Lock()
+	subs := make([]func(Event), 0, len(s.subs))
+	for _, fn := range s.subs {
+		subs = append(subs, fn)
+	}
+	s.mx.Unlock()
+
+	for _, fn := range subs {
+		fn(e)
+	}
+	return true
+}
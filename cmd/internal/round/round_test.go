@@ -0,0 +1,97 @@
+package round_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/clock"
+	"cgoncalveslck/dicegame/cmd/internal/round"
+	"testing"
+	"time"
+)
+
+func TestSchedulerPhases(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	cfg := round.Config{
+		Betting: 3 * time.Second,
+		Locked:  time.Second,
+		Result:  2 * time.Second,
+		Tick:    time.Second,
+	}
+
+	s := round.New(cfg, fake, func() int { return 4 })
+	events := make(chan round.Event, 32)
+	s.Subscribe(func(e round.Event) {
+		events <- e
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+
+	expected := []round.Event{
+		{Round: 1, Phase: round.Betting, Remaining: 3 * time.Second},
+		{Round: 1, Phase: round.Betting, Tick: true, Remaining: 2 * time.Second},
+		{Round: 1, Phase: round.Betting, Tick: true, Remaining: time.Second},
+		{Round: 1, Phase: round.Locked, Remaining: time.Second},
+		{Round: 1, Phase: round.Result, Remaining: 2 * time.Second, Roll: 4},
+		{Round: 1, Phase: round.Result, Tick: true, Remaining: time.Second},
+		{Round: 2, Phase: round.Betting, Remaining: 3 * time.Second},
+	}
+
+	for i, want := range expected {
+		if i > 0 {
+			fake.BlockUntil(1)
+			fake.Advance(time.Second)
+		}
+
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("Event %d: expected %+v but got %+v", i, want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d: timed out waiting for %+v", i, want)
+		}
+	}
+
+	r, phase, endsAt := s.State()
+	if r != 2 || phase != round.Betting {
+		t.Errorf("Expected round 2 BETTING but got %d %s", r, phase)
+	}
+
+	if !endsAt.Equal(fake.Now().Add(3 * time.Second)) {
+		t.Errorf("Expected phase to end in 3s but got %s", endsAt.Sub(fake.Now()))
+	}
+
+	s.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Run to return after Stop")
+	}
+}
+
+func TestSchedulerUnsubscribe(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	s := round.New(round.Config{Betting: time.Second}, fake, func() int { return 1 })
+
+	events := make(chan round.Event, 8)
+	unsubscribe := s.Subscribe(func(e round.Event) {
+		events <- e
+	})
+
+	go s.Run()
+	defer s.Stop()
+
+	<-events
+	unsubscribe()
+
+	fake.BlockUntil(1)
+	fake.Advance(time.Second)
+
+	select {
+	case e := <-events:
+		t.Errorf("Expected no events after unsubscribe but got %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,260 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Bet types the game knows how to settle, rules pick which ones are on
+const (
+	ODD  = "ODD"
+	EVEN = "EVEN"
+	LOW  = "LOW"  // 1 to 3
+	HIGH = "HIGH" // 4 to 6
+)
+
+// The game rules a PLAY session runs with
+// A session keeps the Rules it started with, reloads only apply to new ones
+type Rules struct {
+	Version  string          `json:"version"` // from the file, or a hash of it
+	MinBet   int             `json:"minBet"`
+	MaxBet   int             `json:"maxBet"` // 0 means no maximum
+	BetTypes map[string]*Bet `json:"betTypes"`
+	Features Features        `json:"features"`
+}
+
+type Bet struct {
+	Enabled bool `json:"enabled"`
+	Pays    int  `json:"pays"` // pays Pays to 1, the stake comes back on top
+}
+
+// Whole parts of the game that can be switched off, the ones already
+// running finish
+type Features struct {
+	Jackpot     bool `json:"jackpot"`
+	Tables      bool `json:"tables"`
+	Duels       bool `json:"duels"`
+	Tournaments bool `json:"tournaments"`
+}
+
+// What the game did before it had rules
+func Default() *Rules {
+	return &Rules{
+		Version: "default",
+		MinBet:  1,
+		BetTypes: map[string]*Bet{
+			ODD:  {Enabled: true, Pays: 1},
+			EVEN: {Enabled: true, Pays: 1},
+			LOW:  {Enabled: false, Pays: 1},
+			HIGH: {Enabled: false, Pays: 1},
+		},
+		Features: Features{Jackpot: true, Tables: true, Duels: true, Tournaments: true},
+	}
+}
+
+var current atomic.Pointer[Rules]
+
+func init() {
+	current.Store(Default())
+}
+
+// Rules new sessions start with, never nil
+func Current() *Rules {
+	return current.Load()
+}
+
+// Makes r the rules for new sessions, nothing is changed if it isn't valid
+func Set(r *Rules) error {
+	err := r.Validate()
+	if err != nil {
+		return err
+	}
+	current.Store(r)
+	return nil
+}
+
+func (r *Rules) Validate() error {
+	var errs []error
+	if r.MinBet < 1 {
+		errs = append(errs, errors.New("minBet must be at least 1"))
+	}
+	if r.MaxBet != 0 && r.MaxBet < r.MinBet {
+		errs = append(errs, errors.New("maxBet can't be below minBet"))
+	}
+
+	enabled := 0
+	for name, b := range r.BetTypes {
+		switch name {
+		case ODD, EVEN, LOW, HIGH:
+		default:
+			errs = append(errs, fmt.Errorf("unknown bet type %q", name))
+			continue
+		}
+		if b == nil || b.Pays < 1 {
+			errs = append(errs, fmt.Errorf("%s must pay at least 1 to 1", name))
+			continue
+		}
+		if b.Enabled {
+			enabled++
+		}
+	}
+	if enabled == 0 {
+		errs = append(errs, errors.New("at least one bet type must be enabled"))
+	}
+	return errors.Join(errs...)
+}
+
+// The bet type if it's enabled
+func (r *Rules) Bet(choice string) (*Bet, bool) {
+	b, ok := r.BetTypes[choice]
+	if !ok || !b.Enabled {
+		return nil, false
+	}
+	return b, true
+}
+
+// Enabled bet types, for error messages
+func (r *Rules) Choices() []string {
+	var choices []string
+	for _, name := range []string{ODD, EVEN, LOW, HIGH} {
+		if _, ok := r.Bet(name); ok {
+			choices = append(choices, name)
+		}
+	}
+	return choices
+}
+
+func Wins(choice string, roll int) bool {
+	switch choice {
+	case ODD:
+		// this should be correct and faster but i didn't check
+		return roll&1 != 0
+	case EVEN:
+		return roll&1 == 0
+	case LOW:
+		return roll <= 3
+	case HIGH:
+		return roll >= 4
+	}
+	return false
+}
+
+// Reads rules from a JSON file, anything it leaves out keeps the default,
+// down to single fields of a bet type
+// Without a "version" the version is the start of the file's SHA-256
+func Load(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := Default()
+	r.Version = ""
+
+	// {"LOW": {"pays": 2}} would otherwise replace the whole entry and turn
+	// LOW off
+	type betFile struct {
+		Enabled *bool `json:"enabled"`
+		Pays    *int  `json:"pays"`
+	}
+	type alias Rules
+	file := struct {
+		*alias
+		BetTypes map[string]betFile `json:"betTypes"`
+	}{alias: (*alias)(r)}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, f := range file.BetTypes {
+		b, ok := r.BetTypes[name]
+		if !ok {
+			// unknown names are reported by Validate
+			b = &Bet{}
+			r.BetTypes[name] = b
+		}
+		if f.Enabled != nil {
+			b.Enabled = *f.Enabled
+		}
+		if f.Pays != nil {
+			b.Pays = *f.Pays
+		}
+	}
+	if r.Version == "" {
+		sum := sha256.Sum256(data)
+		r.Version = hex.EncodeToString(sum[:6])
+	}
+
+	err = r.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Loads path into the current rules when it changed, or when reload
+// receives, until ctx is done
+// A file that doesn't load is logged and the current rules stay
+func Watch(ctx context.Context, path string, interval time.Duration, reload <-chan os.Signal, onChange func(*Rules)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var mod time.Time
+	if info, err := os.Stat(path); err == nil {
+		mod = info.ModTime()
+	}
+
+	for {
+		forced := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			forced = true
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Warn("Rules reload failed, keeping the current ones", slog.String("version", Current().Version), slog.Any("error", err))
+			continue
+		}
+		if !forced && info.ModTime().Equal(mod) {
+			continue
+		}
+		mod = info.ModTime()
+
+		r, err := Load(path)
+		if err != nil {
+			slog.Warn("Rules reload failed, keeping the current ones", slog.String("version", Current().Version), slog.Any("error", err))
+			continue
+		}
+		cur := Current()
+		if r.Version == cur.Version {
+			// two different rule sets under one version would make the
+			// history and audit log ambiguous
+			if !reflect.DeepEqual(r, cur) {
+				slog.Warn("Rules changed without a new version, keeping the current ones", slog.String("version", cur.Version))
+			}
+			continue
+		}
+
+		current.Store(r)
+		if onChange != nil {
+			onChange(r)
+		}
+	}
+}
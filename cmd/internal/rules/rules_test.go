@@ -0,0 +1,166 @@
+package rules_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/rules"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, data string, mod time.Time) {
+	err := os.WriteFile(path, []byte(data), 0o600)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	err = os.Chtimes(path, mod, mod)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeFile(t, path, `{"maxBet": 50, "betTypes": {"HIGH": {"enabled": true, "pays": 1}}}`, time.Now())
+
+	r, err := rules.Load(path)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if r.MinBet != 1 || r.MaxBet != 50 || !r.Features.Jackpot {
+		t.Errorf("Expected the file over the defaults but got %+v", r)
+	}
+	if got := strings.Join(r.Choices(), " "); got != "ODD EVEN HIGH" {
+		t.Errorf("Expected ODD EVEN HIGH but got %s", got)
+	}
+
+	// no version in the file, the same contents get the same one
+	again, err := rules.Load(path)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if r.Version == "" || r.Version == "default" || r.Version != again.Version {
+		t.Errorf("Expected a stable version from the contents but got %q and %q", r.Version, again.Version)
+	}
+
+	// entries are merged field by field, pays alone doesn't turn LOW off or on
+	writeFile(t, path, `{"betTypes": {"LOW": {"pays": 2}, "HIGH": {"enabled": true}}}`, time.Now())
+	r, err = rules.Load(path)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if low := r.BetTypes[rules.LOW]; low.Enabled || low.Pays != 2 {
+		t.Errorf("Expected LOW still off paying 2 but got %+v", low)
+	}
+	if high := r.BetTypes[rules.HIGH]; !high.Enabled || high.Pays != 1 {
+		t.Errorf("Expected HIGH on with the default payout but got %+v", high)
+	}
+
+	writeFile(t, path, `{"version": "2024-06", "minBet": 5}`, time.Now())
+	r, err = rules.Load(path)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if r.Version != "2024-06" {
+		t.Errorf("Expected the version from the file but got %q", r.Version)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"min bet", `{"minBet": 0}`},
+		{"max below min", `{"minBet": 10, "maxBet": 5}`},
+		{"unknown bet type", `{"betTypes": {"SEVEN": {"enabled": true, "pays": 5}}}`},
+		{"no payout", `{"betTypes": {"ODD": {"enabled": true, "pays": 0}}}`},
+		{"nothing enabled", `{"betTypes": {"ODD": {"enabled": false, "pays": 1}, "EVEN": {"enabled": false, "pays": 1}}}`},
+		{"unknown field", `{"payouts": 5}`},
+		{"not JSON", `minBet = 5`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			writeFile(t, path, tt.file, time.Now())
+
+			_, err := rules.Load(path)
+			if err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+
+	bad := rules.Default()
+	bad.MinBet = 0
+	if rules.Set(bad) == nil || rules.Current().MinBet != 1 {
+		t.Errorf("Expected invalid rules to be refused")
+	}
+}
+
+func TestWins(t *testing.T) {
+	for roll := 1; roll <= 6; roll++ {
+		if rules.Wins(rules.ODD, roll) == rules.Wins(rules.EVEN, roll) {
+			t.Errorf("Expected exactly one of ODD and EVEN to win on %d", roll)
+		}
+		if rules.Wins(rules.LOW, roll) != (roll <= 3) || rules.Wins(rules.HIGH, roll) != (roll >= 4) {
+			t.Errorf("Expected LOW to win on 1-3 and HIGH on 4-6, rolled %d", roll)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	defer rules.Set(rules.Default())
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	start := time.Now().Add(-time.Hour)
+	writeFile(t, path, `{"version": "v1"}`, start)
+
+	loaded := make(chan *rules.Rules, 10)
+	reload := make(chan os.Signal, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rules.Watch(ctx, path, 10*time.Millisecond, reload, func(r *rules.Rules) { loaded <- r })
+
+	wait := func(version string) {
+		t.Helper()
+		select {
+		case r := <-loaded:
+			if r.Version != version || rules.Current() != r {
+				t.Errorf("Expected %s to be current but got %s", version, rules.Current().Version)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %s to be loaded", version)
+		}
+	}
+
+	// same mtime, only the signal picks it up
+	writeFile(t, path, `{"version": "v2"}`, start)
+	reload <- os.Interrupt
+	wait("v2")
+
+	writeFile(t, path, `{"version": "v3", "maxBet": 100}`, start.Add(time.Minute))
+	wait("v3")
+
+	// a broken file keeps v3
+	writeFile(t, path, `{"version": "v4", "minBet": 0}`, start.Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if rules.Current().Version != "v3" {
+		t.Errorf("Expected v3 to stay but got %s", rules.Current().Version)
+	}
+
+	// different rules under a version that's already loaded are refused
+	writeFile(t, path, `{"version": "v3", "maxBet": 200}`, start.Add(3*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case r := <-loaded:
+		t.Errorf("Expected nothing to load but got %+v", r)
+	default:
+	}
+	if rules.Current().MaxBet != 100 {
+		t.Errorf("Expected v3 to keep maxBet 100 but got %d", rules.Current().MaxBet)
+	}
+}
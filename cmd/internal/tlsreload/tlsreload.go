@@ -0,0 +1,130 @@
+package tlsreload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Serves the certificate in certFile/keyFile and picks up new ones when the
+// files change, handshakes after a reload get the new certificate while
+// connections already open keep going with the old one
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	cert    atomic.Pointer[tls.Certificate]
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	_, err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// For tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Loads the files again if either changed since the last load, true if it
+// did. On error the current certificate stays in use
+// Only Watch calls it after New, not safe to call from several goroutines
+func (r *Reloader) Reload() (bool, error) {
+	certMod, err := modTime(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyMod, err := modTime(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if r.cert.Load() != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// the two files are usually replaced one after the other, the next
+		// check sees them both
+		return false, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return false, fmt.Errorf("certificate expired on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	r.cert.Store(&cert)
+	r.certMod, r.keyMod = certMod, keyMod
+
+	slog.Info("TLS certificate loaded", slog.String("subject", cert.Leaf.Subject.String()), slog.Time("notAfter", cert.Leaf.NotAfter))
+	return true, nil
+}
+
+// Checks the files every interval until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last error
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := r.Reload()
+		// a file half written is logged once, not on every tick
+		if err != nil && (last == nil || err.Error() != last.Error()) {
+			slog.Warn("TLS certificate reload failed, keeping the current one", slog.Any("error", err))
+		}
+		last = err
+	}
+}
+
+// Server config for the reloader, with clientCAFile client certificates are
+// asked for and verified when sent, RequireClientCert decides who needs one
+func (r *Reloader) Config(clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in " + clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
@@ -0,0 +1,179 @@
+package tlsreload_test
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/tlsreload"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for name with mod as the files' mtime
+func writeCert(t *testing.T, certFile, keyFile, name string, serial int64, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	// some filesystems only keep seconds, don't rely on the clock moving
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+}
+
+// Serial of the certificate a new handshake gets
+func served(t *testing.T, addr string) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeCert(t, certFile, keyFile, "localhost", 1, start)
+
+	r, err := tlsreload.New(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	cfg, err := r.Config("")
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// echoes until the client closes
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 1)
+				for {
+					_, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(buf)
+				}
+			}(conn)
+		}
+	}()
+	addr := ln.Addr().String()
+
+	if s := served(t, addr); s != 1 {
+		t.Fatalf("Expected serial 1 but got %d", s)
+	}
+
+	// an open connection isn't touched by a reload
+	open, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	defer open.Close()
+
+	changed, err := r.Reload()
+	if changed || err != nil {
+		t.Errorf("Expected nothing to reload but got %v %v", changed, err)
+	}
+
+	writeCert(t, certFile, keyFile, "localhost", 2, start.Add(time.Second))
+	changed, err = r.Reload()
+	if !changed || err != nil {
+		t.Fatalf("Expected a reload but got %v %v", changed, err)
+	}
+	if s := served(t, addr); s != 2 {
+		t.Errorf("Expected serial 2 after the reload but got %d", s)
+	}
+
+	buf := []byte{42}
+	_, err = open.Write(buf)
+	if err == nil {
+		_, err = open.Read(buf)
+	}
+	if err != nil || buf[0] != 42 {
+		t.Errorf("Expected the open connection to survive the reload: %+v", err)
+	}
+	if s := open.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); s != 1 {
+		t.Errorf("Expected the open connection to keep serial 1 but got %d", s)
+	}
+
+	// a broken file keeps the last good certificate
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	os.Chtimes(keyFile, start.Add(2*time.Second), start.Add(2*time.Second))
+	_, err = r.Reload()
+	if err == nil {
+		t.Errorf("Expected a broken key to fail")
+	}
+	if s := served(t, addr); s != 2 {
+		t.Errorf("Expected serial 2 to stay after a failed reload but got %d", s)
+	}
+}
+
+func TestClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "localhost", 1, time.Now())
+
+	r, err := tlsreload.New(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+
+	cfg, err := r.Config(certFile)
+	if err != nil {
+		t.Fatalf("Error: %+v", err)
+	}
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven || cfg.ClientCAs == nil {
+		t.Errorf("Expected client certificates to be verified when given")
+	}
+
+	_, err = r.Config(keyFile)
+	if err == nil {
+		t.Errorf("Expected a file without certificates to fail")
+	}
+}
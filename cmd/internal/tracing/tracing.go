@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"cgoncalveslck/dicegame/cmd/internal/logging"
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const name = "cgoncalveslck/dicegame"
+
+// Installs the global tracer provider
+// exporter is "stdout", "otlp" (endpoint and the rest from the standard
+// OTEL_EXPORTER_OTLP_* variables), or "" / "none" to keep tracing off
+// The returned function flushes and stops it, call it on shutdown
+func Setup(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("dicegame"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp.Shutdown, nil
+}
+
+// Starts a span with the global provider, a no-op until Setup installs one
+func Start(ctx context.Context, span string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(name).Start(ctx, span, opts...)
+}
+
+// Starts a span under the one already in ctx, without one (timers, HTTP
+// requests that aren't traced) nothing is started and ctx is returned as is
+func StartChild(ctx context.Context, span string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return Start(ctx, span, opts...)
+}
+
+// Trace context sent with the WebSocket upgrade, if the client has one
+func Extract(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// client.id attribute for a span, written as its logging.Pseudonym like in
+// the logs since a guest's id is enough to log in as them
+func ClientID(id string) attribute.KeyValue {
+	if id == "" {
+		return attribute.String("client.id", "")
+	}
+	return attribute.String("client.id", logging.Pseudonym(id))
+}
+
+// Marks span as failed with a game error code
+func ErrorCode(span trace.Span, code int, message string) {
+	span.SetAttributes(attribute.Int("error.code", code))
+	span.SetStatus(codes.Error, message)
+}
+
+// Records err on span if there is one
+func Error(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}